@@ -1,53 +1,273 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf16"
 )
 
 type OrganizeMethod string
 
 const (
-	ByType OrganizeMethod = "type"
-	BySize OrganizeMethod = "size"
-	ByDate OrganizeMethod = "date"
+	ByType    OrganizeMethod = "type"
+	BySize    OrganizeMethod = "size"
+	ByDate    OrganizeMethod = "date"
+	ByArchive OrganizeMethod = "archive"
+	ByMusic   OrganizeMethod = "music"
 )
 
+// Fallback value that leaves untagged audio files where they are
+const skipFallback = "skip"
+
+// AudioTags holds the fields the music method reads from audio files
+type AudioTags struct {
+	Title       string
+	Artist      string
+	AlbumArtist string
+	Album       string
+	Track       int
+}
+
+// Directory, relative to the organized directory, that holds monthly bundles
+const archiveDirName = "Archive"
+
+// Name of the manifest stored inside every archive bundle
+const manifestName = "MANIFEST.json"
+
+// ArchiveManifest lists every file packed into a bundle
+type ArchiveManifest struct {
+	Bundle  string          `json:"bundle"`
+	Updated time.Time       `json:"updated"`
+	Files   []ManifestEntry `json:"files"`
+}
+
+type ManifestEntry struct {
+	Name       string    `json:"name"`
+	Original   string    `json:"original"`
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"mod_time"`
+	SHA256     string    `json:"sha256"`
+	ArchivedAt time.Time `json:"archived_at"`
+}
+
+type PlacementMode string
+
+const (
+	MoveMode     PlacementMode = "move"
+	CopyMode     PlacementMode = "copy"
+	SymlinkMode  PlacementMode = "symlink"
+	HardlinkMode PlacementMode = "hardlink"
+)
+
+type ConflictStrategy string
+
+const (
+	RenameOnConflict     ConflictStrategy = "rename"
+	SkipOnConflict       ConflictStrategy = "skip"
+	OverwriteOnConflict  ConflictStrategy = "overwrite"
+	KeepNewerOnConflict  ConflictStrategy = "keep-newer"
+	KeepLargerOnConflict ConflictStrategy = "keep-larger"
+	DedupeOnConflict     ConflictStrategy = "dedupe"
+)
+
+// ConflictDecision records how a name conflict in a target directory was resolved
+type ConflictDecision struct {
+	Source string
+	Target string
+	Action string
+}
+
+// Actions used in plan operations besides the placement modes
+const (
+	SkipAction    = "skip"
+	KeepAction    = "keep"
+	RemoveAction  = "remove"
+	FlattenAction = "flatten"
+	ArchiveAction = "archive"
+)
+
+// Number of report rows kept in watch mode
+const watchReportLimit = 1000
+
+// Name of the per-directory file listing paths the organizer must not touch
+const ignoreFileName = ".organizeignore"
+
+// FileStamp captures the state of a file when a plan was made
+type FileStamp struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// Operation is a single planned change. Action is a placement mode
+// (move, copy, symlink, hardlink) or one of skip, keep, remove, flatten
+// and archive.
+type Operation struct {
+	Action    string     `json:"action"`
+	Source    string     `json:"source"`
+	Target    string     `json:"target,omitempty"`
+	Category  string     `json:"category"`
+	Reason    string     `json:"reason"`
+	Conflict  string     `json:"conflict,omitempty"`
+	Overwrite bool       `json:"overwrite,omitempty"`
+	SourceAt  FileStamp  `json:"source_state"`
+	TargetAt  *FileStamp `json:"target_state,omitempty"`
+}
+
+// Plan is a reviewable list of operations. Paths in a saved plan are
+// relative to Directory.
+type Plan struct {
+	CreatedAt  time.Time        `json:"created_at"`
+	Directory  string           `json:"directory"`
+	Method     OrganizeMethod   `json:"method"`
+	Mode       PlacementMode    `json:"mode"`
+	OnConflict ConflictStrategy `json:"on_conflict"`
+	Rename     string           `json:"rename,omitempty"`
+	Operations []Operation      `json:"operations"`
+}
+
+// FileReport is one row of a run report: what happened to a single file
+type FileReport struct {
+	Action      string `json:"action"`
+	Source      string `json:"source"`
+	Destination string `json:"destination,omitempty"`
+	Category    string `json:"category,omitempty"`
+	Bytes       int64  `json:"bytes"`
+	Reason      string `json:"reason,omitempty"`
+	Conflict    string `json:"conflict,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
 type FileInfo struct {
 	Path     string
 	Info     os.FileInfo
 	Category string
+	Tags     *AudioTags
 }
 
 type Organizer struct {
-	Directory string
-	Method    OrganizeMethod
-	Recursive bool
-	DryRun    bool
-	Force     bool
-	Verbose   bool
-	Stats     map[string]int
+	Directory     string
+	Method        OrganizeMethod
+	Mode          PlacementMode
+	Rename        *RenameTemplate
+	Recursive     bool
+	Flatten       bool
+	PruneEmpty    bool
+	DryRun        bool
+	OnConflict    ConflictStrategy
+	Verbose       bool
+	PollInterval  time.Duration
+	SettleTime    time.Duration
+	Stats         map[string]int
+	Conflicts     []ConflictDecision
+	Refused       []string
+	Pruned        []string
+	ArchiveAge    time.Duration
+	ArchiveExt    string
+	MusicFallback string
+	Workers       int
+	Report        []FileReport
+	// When positive, only the most recent ReportLimit rows are kept
+	ReportLimit int
+
+	// Targets claimed by earlier operations while a plan is being built, and
+	// the operation claiming each
+	reserved map[string]*Operation
+	// Per-category counters for the {seq} rename field
+	sequences map[string]int
+	// Source directories and how many entries were moved out of them
+	vacated map[string]int
+	// Archive operations waiting to be written, keyed by bundle path
+	archiveQueue map[string][]Operation
+	// Failed operations, including those dropped from a limited Report
+	failed int
+
+	// Guards results shared by concurrently applied operations
+	mu sync.Mutex
+}
+
+// ignoreRule is one pattern line from an .organizeignore file
+type ignoreRule struct {
+	pattern *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// ignoreMatcher applies .organizeignore files with gitignore semantics.
+// Rules are keyed by the slash-separated directory, relative to root, that
+// holds the ignore file; deeper files take precedence.
+type ignoreMatcher struct {
+	root  string
+	rules map[string][]ignoreRule
+}
+
+// pendingFile tracks a file seen in watch mode until it stops changing
+type pendingFile struct {
+	size        int64
+	modTime     time.Time
+	stableSince time.Time
+}
+
+// Extensions used by browsers and download managers for incomplete files
+var partialDownloadExts = map[string]bool{
+	".part": true, ".crdownload": true, ".download": true,
+	".partial": true, ".tmp": true,
 }
 
 func main() {
 	var (
 		directory = flag.String("d", ".", "Directory to organize")
-		method    = flag.String("b", "type", "Organization method (type, size, date)")
+		method    = flag.String("b", "type", "Organization method (type, size, date, archive, music)")
+		mode      = flag.String("mode", "move", "Placement mode (move, copy, symlink, hardlink)")
 		recursive = flag.Bool("r", false, "Process subdirectories recursively")
 		dryRun    = flag.Bool("n", false, "Dry run - show what would be done")
-		force     = flag.Bool("f", false, "Force overwrite existing files")
+		force     = flag.Bool("f", false, "Force overwrite existing files (same as -on-conflict overwrite)")
+		conflict  = flag.String("on-conflict", "rename", "Conflict strategy (rename, skip, overwrite, keep-newer, keep-larger, dedupe)")
 		verbose   = flag.Bool("v", false, "Verbose output")
+		flatten   = flag.Bool("flatten", false, "Pull files out of nested directories before categorizing (implies -r)")
+		prune     = flag.Bool("prune-empty", false, "Remove source directories left empty by the organizer")
+		rename    = flag.String("rename", "", "Rename template applied while organizing (e.g. {date:2006-01-02}_{name|slug}{ext})")
+		archDays  = flag.Int("archive-days", 90, "Archive files not modified for this many days (archive method)")
+		archFmt   = flag.String("archive-format", "zip", "Bundle format for the archive method (zip, tar.gz)")
+		fallback  = flag.String("music-fallback", "Unknown Artist/Unknown Album", "Directory for audio files without tags, or \"skip\" to leave them (music method)")
+		workers   = flag.Int("workers", runtime.NumCPU(), "Number of files processed concurrently")
+		report    = flag.String("report", "", "Write a per-file report (json, csv); watch mode keeps the last 1000 rows")
+		reportOut = flag.String("report-file", "", "File for the -report output (default: stdout)")
+		planOut   = flag.String("plan", "", "Write the planned operations to a JSON file instead of organizing")
+		watch     = flag.Bool("watch", false, "Keep running and organize new files as they appear")
+		interval  = flag.Duration("interval", 2*time.Second, "Polling interval in watch mode")
+		settle    = flag.Duration("settle", 5*time.Second, "Time a file must stop changing before it is moved in watch mode")
 		help      = flag.Bool("h", false, "Show help")
 	)
 
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [options] apply plan.json\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "Organize files in a directory by type, size, or date.\n\n")
 		fmt.Fprintf(os.Stderr, "Options:\n")
 		flag.PrintDefaults()
@@ -55,9 +275,40 @@ func main() {
 		fmt.Fprintf(os.Stderr, "  type  - Group files by extension (Images, Documents, etc.)\n")
 		fmt.Fprintf(os.Stderr, "  size  - Group by file size (Small, Medium, Large)\n")
 		fmt.Fprintf(os.Stderr, "  date  - Group by modification date (Today, This Week, etc.)\n")
+		fmt.Fprintf(os.Stderr, "  archive - Pack stale files into monthly bundles (Archive/2023-04.zip)\n")
+		fmt.Fprintf(os.Stderr, "  music - Sort MP3/FLAC/OGG files by tags into Artist/Album/NN - Title.ext\n")
+		fmt.Fprintf(os.Stderr, "\nPlacement Modes:\n")
+		fmt.Fprintf(os.Stderr, "  move     - Move files into category directories (default)\n")
+		fmt.Fprintf(os.Stderr, "  copy     - Copy files, leaving the originals in place\n")
+		fmt.Fprintf(os.Stderr, "  symlink  - Create relative symbolic links to the originals\n")
+		fmt.Fprintf(os.Stderr, "  hardlink - Create hard links to the originals\n")
+		fmt.Fprintf(os.Stderr, "\nConflict Strategies:\n")
+		fmt.Fprintf(os.Stderr, "  rename      - Add a numbered suffix to the incoming file (default)\n")
+		fmt.Fprintf(os.Stderr, "  skip        - Leave the incoming file where it is\n")
+		fmt.Fprintf(os.Stderr, "  overwrite   - Replace the existing file\n")
+		fmt.Fprintf(os.Stderr, "  keep-newer  - Keep whichever file was modified most recently\n")
+		fmt.Fprintf(os.Stderr, "  keep-larger - Keep whichever file is larger\n")
+		fmt.Fprintf(os.Stderr, "  dedupe      - Drop the incoming file if its content is identical, otherwise rename\n")
+		fmt.Fprintf(os.Stderr, "\nRename Templates:\n")
+		fmt.Fprintf(os.Stderr, "  Fields:  {name} {ext} {category} {date} {date:LAYOUT} {seq} {seq:WIDTH}\n")
+		fmt.Fprintf(os.Stderr, "           {artist} {album} {title} {track} {track:WIDTH} (audio tags)\n")
+		fmt.Fprintf(os.Stderr, "  Filters: {field|filter|...} with lower, upper, ascii, safe, collapse, trim, slug\n")
+		fmt.Fprintf(os.Stderr, "\nIgnore Files:\n")
+		fmt.Fprintf(os.Stderr, "  Paths matching patterns in %s files (gitignore syntax, at any level)\n", ignoreFileName)
+		fmt.Fprintf(os.Stderr, "  are never touched. Hidden files and directories are always skipped.\n")
 		fmt.Fprintf(os.Stderr, "\nExamples:\n")
 		fmt.Fprintf(os.Stderr, "  %s -d Downloads --dry-run\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s -b size -r ~/Desktop\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -d ~/Downloads -watch -settle 10s\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -d ~/Projects -r -mode symlink\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -d Downloads -on-conflict dedupe\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -d Photos -n -rename '{date:2006-01-02}_{name|slug}{ext|lower}'\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -d Downloads -flatten -prune-empty\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -d Downloads -b archive -archive-days 180 -archive-format tar.gz\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -d ~/Music/Inbox -b music -music-fallback Unsorted\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -d /shared -r -workers 16 -report csv -report-file run.csv\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -d /shared -r -plan plan.json\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -v apply plan.json\n", os.Args[0])
 	}
 
 	flag.Parse()
@@ -67,14 +318,139 @@ func main() {
 		return
 	}
 
+	// Parse placement mode
+	placement := PlacementMode(*mode)
+	switch placement {
+	case MoveMode, CopyMode, SymlinkMode, HardlinkMode:
+		// Valid mode
+	default:
+		log.Fatalf("Invalid placement mode: %s (use move, copy, symlink, or hardlink)", *mode)
+	}
+	if *flatten && placement != MoveMode {
+		log.Fatalf("Invalid placement mode for -flatten: %s (flattening moves files, use -mode move)", *mode)
+	}
+
+	// Parse conflict strategy
+	strategy := ConflictStrategy(*conflict)
+	switch strategy {
+	case RenameOnConflict, SkipOnConflict, OverwriteOnConflict,
+		KeepNewerOnConflict, KeepLargerOnConflict, DedupeOnConflict:
+		// Valid strategy
+	default:
+		log.Fatalf("Invalid conflict strategy: %s (use rename, skip, overwrite, keep-newer, keep-larger, or dedupe)", *conflict)
+	}
+	if *force {
+		strategy = OverwriteOnConflict
+	}
+
+	// Parse archive options
+	if *archFmt != "zip" && *archFmt != "tar.gz" {
+		log.Fatalf("Invalid archive format: %s (use zip or tar.gz)", *archFmt)
+	}
+	if *archDays < 0 {
+		log.Fatalf("Invalid archive age: %d days", *archDays)
+	}
+
+	// Parse report format
+	if *report != "" && *report != "json" && *report != "csv" {
+		log.Fatalf("Invalid report format: %s (use json or csv)", *report)
+	}
+	if *workers < 1 {
+		log.Fatalf("Invalid number of workers: %d", *workers)
+	}
+
+	// Parse music fallback
+	musicFallback := filepath.Clean(*fallback)
+	if *fallback != skipFallback && (musicFallback == "." || filepath.IsAbs(musicFallback) || strings.HasPrefix(musicFallback, "..")) {
+		log.Fatalf("Invalid music fallback: %s (use a relative directory or skip)", *fallback)
+	}
+
+	// Parse rename template
+	var renameTemplate *RenameTemplate
+	if *rename != "" {
+		var err error
+		renameTemplate, err = ParseRenameTemplate(*rename)
+		if err != nil {
+			log.Fatalf("Invalid rename template: %v", err)
+		}
+	}
+
 	organizer := &Organizer{
-		Directory: *directory,
-		Method:    OrganizeMethod(*method),
-		Recursive: *recursive,
-		DryRun:    *dryRun,
-		Force:     *force,
-		Verbose:   *verbose,
-		Stats:     make(map[string]int),
+		Directory:     *directory,
+		Method:        OrganizeMethod(*method),
+		Mode:          placement,
+		Recursive:     *recursive || *flatten,
+		Flatten:       *flatten,
+		PruneEmpty:    *prune,
+		DryRun:        *dryRun,
+		OnConflict:    strategy,
+		Verbose:       *verbose,
+		PollInterval:  *interval,
+		SettleTime:    *settle,
+		Rename:        renameTemplate,
+		ArchiveAge:    time.Duration(*archDays) * 24 * time.Hour,
+		ArchiveExt:    "." + *archFmt,
+		MusicFallback: musicFallback,
+		Workers:       *workers,
+		Stats:         make(map[string]int),
+	}
+
+	if flag.Arg(0) == "apply" {
+		if flag.NArg() != 2 {
+			fmt.Fprintf(os.Stderr, "Error: apply requires exactly one plan file\n\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+
+		plan, err := LoadPlan(flag.Arg(1))
+		if err != nil {
+			log.Fatalf("Failed to load plan: %v", err)
+		}
+
+		if err := organizer.ApplyPlan(plan); err != nil {
+			log.Fatalf("Apply failed: %v", err)
+		}
+
+		organizer.PrintSummary()
+		writeReportOrExit(organizer, *report, *reportOut)
+		return
+	}
+
+	if *planOut != "" {
+		plan, err := organizer.Plan()
+		if err != nil {
+			log.Fatalf("Planning failed: %v", err)
+		}
+
+		if err := plan.Save(*planOut); err != nil {
+			log.Fatalf("Failed to write plan: %v", err)
+		}
+
+		printPlanSummary(plan, *planOut)
+		return
+	}
+
+	if *watch {
+		// Setup signal handling
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+
+		stop := make(chan struct{})
+		go func() {
+			<-sigChan
+			fmt.Println("\n\nShutting down gracefully...")
+			close(stop)
+		}()
+
+		// A long-running watch only keeps the latest rows for -report
+		organizer.ReportLimit = watchReportLimit
+		if err := organizer.Watch(stop); err != nil {
+			log.Fatalf("Watch failed: %v", err)
+		}
+
+		organizer.PrintSummary()
+		writeReportOrExit(organizer, *report, *reportOut)
+		return
 	}
 
 	if err := organizer.Organize(); err != nil {
@@ -82,10 +458,32 @@ func main() {
 	}
 
 	organizer.PrintSummary()
+	writeReportOrExit(organizer, *report, *reportOut)
 }
 
-func (o *Organizer) Organize() error {
-	// Check if directory exists
+func writeReportOrExit(o *Organizer, format, path string) {
+	if format == "" {
+		return
+	}
+
+	out := os.Stdout
+	if path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			log.Fatalf("Failed to create report: %v", err)
+		}
+		defer f.Close()
+		out = f
+	} else {
+		fmt.Println()
+	}
+
+	if err := o.WriteReport(out, format); err != nil {
+		log.Fatalf("Failed to write report: %v", err)
+	}
+}
+
+func (o *Organizer) checkDirectory() error {
 	info, err := os.Stat(o.Directory)
 	if err != nil {
 		return fmt.Errorf("cannot access directory: %w", err)
@@ -95,13 +493,30 @@ func (o *Organizer) Organize() error {
 		return fmt.Errorf("path is not a directory: %s", o.Directory)
 	}
 
+	return nil
+}
+
+func (o *Organizer) Organize() error {
+	// Check if directory exists
+	if err := o.checkDirectory(); err != nil {
+		return err
+	}
+
 	if o.DryRun {
 		fmt.Printf("DRY RUN: No files will be moved\n\n")
 	}
 
 	fmt.Printf("Organizing files in: %s\n", o.Directory)
 	fmt.Printf("Method: %s\n", o.Method)
-	if o.Recursive {
+	if o.Mode != MoveMode {
+		fmt.Printf("Placement: %s\n", o.Mode)
+	}
+	if o.Rename != nil {
+		fmt.Printf("Rename: %s\n", o.Rename)
+	}
+	if o.Flatten {
+		fmt.Printf("Mode: Recursive, flattening nested files\n")
+	} else if o.Recursive {
 		fmt.Printf("Mode: Recursive\n")
 	}
 	fmt.Println()
@@ -119,240 +534,2701 @@ func (o *Organizer) Organize() error {
 
 	fmt.Printf("Found %d files to organize\n\n", len(files))
 
-	// Organize files
-	for _, file := range files {
-		if err := o.organizeFile(file); err != nil {
-			log.Printf("Failed to organize %s: %v", file.Path, err)
-		}
+	// Plan every file first so targets are resolved against each other,
+	// then carry out the operations
+	o.runOperations(o.planFiles(files), false)
+	o.flushArchives()
+
+	if o.PruneEmpty {
+		o.pruneEmptyDirs()
 	}
 
 	return nil
 }
 
-func (o *Organizer) scanDirectory() ([]FileInfo, error) {
-	var files []FileInfo
+// Plan scans the directory and returns the operations Organize would
+// perform, without touching any files.
+func (o *Organizer) Plan() (*Plan, error) {
+	if err := o.checkDirectory(); err != nil {
+		return nil, err
+	}
 
-	walkFunc := func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
+	files, err := o.scanDirectory()
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan directory: %w", err)
+	}
 
-		// Skip directories
-		if info.IsDir() {
-			return nil
-		}
+	plan := &Plan{
+		CreatedAt:  time.Now(),
+		Directory:  o.Directory,
+		Method:     o.Method,
+		Mode:       o.Mode,
+		OnConflict: o.OnConflict,
+		Operations: o.planFiles(files),
+	}
+	if o.Rename != nil {
+		plan.Rename = o.Rename.String()
+	}
+	return plan, nil
+}
 
-		// Skip hidden files
-		if strings.HasPrefix(filepath.Base(path), ".") {
-			return nil
+func (o *Organizer) planFiles(files []FileInfo) []Operation {
+	o.reserved = make(map[string]*Operation)
+	defer func() { o.reserved = nil }()
+
+	// Operations are held by pointer until the end, since a later file may
+	// still take over the target of an earlier one
+	var planned []*Operation
+	for _, file := range files {
+		if o.Flatten && filepath.Clean(filepath.Dir(file.Path)) != filepath.Clean(o.Directory) &&
+			filepath.Clean(filepath.Dir(file.Path)) != filepath.Join(o.Directory, file.Category) {
+			flat := o.planFlatten(file)
+			planned = append(planned, flat)
+			file.Path = flat.Target
 		}
 
-		// Skip the organizer executable itself
-		if filepath.Base(path) == filepath.Base(os.Args[0]) {
-			return nil
+		op, err := o.planFile(file)
+		if err != nil {
+			log.Printf("Failed to plan %s: %v", file.Path, err)
+			o.recordResult(Operation{Action: "plan", Source: file.Path, Category: file.Category,
+				SourceAt: FileStamp{Size: file.Info.Size()}}, err)
+			continue
 		}
+		if op != nil {
+			planned = append(planned, op)
+		}
+	}
 
-		// Get file category based on organization method
-		category := o.getFileCategory(path, info)
+	ops := make([]Operation, 0, len(planned))
+	for _, op := range planned {
+		ops = append(ops, *op)
+	}
+	return ops
+}
 
-		files = append(files, FileInfo{
-			Path:     path,
-			Info:     info,
-			Category: category,
-		})
+// planFlatten moves a nested file up into the top-level directory. The file
+// is then categorized from there by a following operation.
+func (o *Organizer) planFlatten(file FileInfo) *Operation {
+	target := filepath.Join(o.Directory, filepath.Base(file.Path))
+	reason := "flatten nested file"
+	if o.targetTaken(target) {
+		target = o.getUniqueFilename(target)
+		reason += "; name taken, renamed to " + filepath.Base(target)
+	}
 
-		return nil
+	op := &Operation{
+		Action:   FlattenAction,
+		Source:   file.Path,
+		Target:   target,
+		Category: file.Category,
+		Reason:   reason,
+		SourceAt: FileStamp{Size: file.Info.Size(), ModTime: file.Info.ModTime()},
 	}
+	o.reserve(op)
+	return op
+}
 
-	if o.Recursive {
-		err := filepath.Walk(o.Directory, walkFunc)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		entries, err := os.ReadDir(o.Directory)
-		if err != nil {
-			return nil, err
-		}
+// ApplyPlan carries out a plan made earlier, refusing any operation whose
+// files changed since planning.
+func (o *Organizer) ApplyPlan(plan *Plan) error {
+	o.Directory = plan.Directory
+	if err := o.checkDirectory(); err != nil {
+		return err
+	}
 
-		for _, entry := range entries {
-			if entry.IsDir() {
-				continue
-			}
+	if o.DryRun {
+		fmt.Printf("DRY RUN: No files will be moved\n\n")
+	}
 
-			path := filepath.Join(o.Directory, entry.Name())
-			info, err := entry.Info()
-			if err != nil {
-				continue
-			}
+	fmt.Printf("Applying plan for: %s\n", plan.Directory)
+	fmt.Printf("Planned: %s (%d operations)\n\n", plan.CreatedAt.Format(time.RFC3339), len(plan.Operations))
 
-			if err := walkFunc(path, info, nil); err != nil {
-				continue
-			}
-		}
+	o.runOperations(plan.Operations, true)
+	o.flushArchives()
+
+	if o.PruneEmpty {
+		o.pruneEmptyDirs()
 	}
 
-	return files, nil
+	return nil
 }
 
-func (o *Organizer) getFileCategory(path string, info os.FileInfo) string {
-	switch o.Method {
-	case ByType:
-		return o.getTypeCategory(path)
-	case BySize:
-		return o.getSizeCategory(info.Size())
-	case ByDate:
-		return o.getDateCategory(info.ModTime())
-	default:
-		return "Other"
+// runOperations applies operations on a pool of Workers goroutines. An
+// operation that continues from another one's target (a flattened file being
+// categorized) runs after it on the same worker. Dry runs stay sequential so
+// their output reads in plan order.
+func (o *Organizer) runOperations(ops []Operation, verify bool) {
+	var chains [][]Operation
+	last := make(map[string]int)
+	for _, op := range ops {
+		if i, ok := last[op.Source]; ok {
+			chains[i] = append(chains[i], op)
+		} else {
+			chains = append(chains, []Operation{op})
+			i = len(chains) - 1
+			last[op.Source] = i
+		}
+		if op.Target != "" {
+			last[op.Target] = last[op.Source]
+		}
 	}
-}
 
-func (o *Organizer) getTypeCategory(path string) string {
-	ext := strings.ToLower(filepath.Ext(path))
-
-	// Image files
-	imageExts := map[string]bool{
-		".jpg": true, ".jpeg": true, ".png": true, ".gif": true,
-		".bmp": true, ".tiff": true, ".webp": true, ".svg": true,
+	workers := o.Workers
+	if workers < 1 || o.DryRun {
+		workers = 1
 	}
-	if imageExts[ext] {
-		return "Images"
+
+	var done, failed int64
+	stopProgress := o.startProgress(len(ops), &done, &failed)
+	defer stopProgress()
+
+	jobs := make(chan []Operation)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chain := range jobs {
+				for j, op := range chain {
+					// In a dry run, later steps of a chain work on files
+					// that have not been moved yet
+					check := verify && !(o.DryRun && j > 0)
+					ok := o.runOperation(op, check)
+					atomic.AddInt64(&done, 1)
+					if !ok {
+						atomic.AddInt64(&failed, int64(len(chain)-j))
+						atomic.AddInt64(&done, int64(len(chain)-j-1))
+						break
+					}
+				}
+			}
+		}()
 	}
 
-	// Document files
-	docExts := map[string]bool{
-		".pdf": true, ".doc": true, ".docx": true, ".txt": true,
-		".rtf": true, ".odt": true, ".pages": true,
+	for _, chain := range chains {
+		jobs <- chain
 	}
-	if docExts[ext] {
-		return "Documents"
+	close(jobs)
+	wg.Wait()
+}
+
+// runOperation verifies (when asked) and applies a single operation,
+// recording the outcome in the report.
+func (o *Organizer) runOperation(op Operation, verify bool) bool {
+	if verify {
+		if err := o.verifyOperation(op); err != nil {
+			relPath, _ := filepath.Rel(o.Directory, op.Source)
+			o.mu.Lock()
+			o.Refused = append(o.Refused, fmt.Sprintf("%s: %v", relPath, err))
+			o.mu.Unlock()
+			log.Printf("Refusing %s %s: %v", op.Action, relPath, err)
+			o.recordResult(op, fmt.Errorf("refused: %w", err))
+			return false
+		}
 	}
 
-	// Video files
-	videoExts := map[string]bool{
-		".mp4": true, ".avi": true, ".mkv": true, ".mov": true,
-		".wmv": true, ".flv": true, ".webm": true, ".m4v": true,
+	if err := o.applyOperation(op); err != nil {
+		log.Printf("Failed to organize %s: %v", op.Source, err)
+		o.recordResult(op, err)
+		return false
 	}
-	if videoExts[ext] {
-		return "Videos"
+
+	// Archived files are reported once their bundle has been written
+	if op.Action != ArchiveAction || o.DryRun {
+		o.recordResult(op, nil)
 	}
+	return true
+}
 
-	// Audio files
-	audioExts := map[string]bool{
-		".mp3": true, ".wav": true, ".flac": true, ".aac": true,
-		".ogg": true, ".wma": true, ".m4a": true,
+func (o *Organizer) recordResult(op Operation, err error) {
+	entry := FileReport{
+		Action:   op.Action,
+		Source:   relToDir(o.Directory, op.Source),
+		Category: op.Category,
+		Bytes:    op.SourceAt.Size,
+		Reason:   op.Reason,
+		Conflict: op.Conflict,
 	}
-	if audioExts[ext] {
-		return "Audio"
+	if op.Target != "" {
+		entry.Destination = relToDir(o.Directory, op.Target)
+	}
+	if err != nil {
+		entry.Error = err.Error()
 	}
 
-	// Archive files
-	archiveExts := map[string]bool{
-		".zip": true, ".rar": true, ".7z": true, ".tar": true,
-		".gz": true, ".bz2": true, ".xz": true,
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err != nil {
+		o.failed++
 	}
-	if archiveExts[ext] {
-		return "Archives"
+	o.Report = append(o.Report, entry)
+	// Trim in batches so the slice is not copied on every row
+	if o.ReportLimit > 0 && len(o.Report) >= 2*o.ReportLimit {
+		o.Report = append(o.Report[:0], o.Report[len(o.Report)-o.ReportLimit:]...)
 	}
+}
 
-	// Code files
-	codeExts := map[string]bool{
-		".go": true, ".js": true, ".py": true, ".java": true,
-		".cpp": true, ".c": true, ".h": true, ".html": true,
-		".css": true, ".php": true, ".rb": true, ".swift": true,
-		".rs": true, ".ts": true, ".jsx": true, ".tsx": true,
+// startProgress redraws a progress line on stderr while operations run. It
+// only draws when stderr is a terminal and no per-file output is printed.
+func (o *Organizer) startProgress(total int, done, failed *int64) func() {
+	info, err := os.Stderr.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 || o.Verbose || o.DryRun || total == 0 {
+		return func() {}
 	}
-	if codeExts[ext] {
-		return "Code"
+
+	draw := func() {
+		d := atomic.LoadInt64(done)
+		fmt.Fprintf(os.Stderr, "\rProcessed %d/%d files (%.1f%%), %d failed",
+			d, total, float64(d)*100/float64(total), atomic.LoadInt64(failed))
 	}
 
-	return "Other"
+	stop := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(200 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				draw()
+			case <-stop:
+				draw()
+				fmt.Fprintln(os.Stderr)
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-finished
+	}
 }
 
-func (o *Organizer) getSizeCategory(size int64) string {
-	const (
-		MB = 1024 * 1024
-		KB = 1024
-	)
+// reportRows returns the rows WriteReport writes, at most ReportLimit of them
+func (o *Organizer) reportRows() []FileReport {
+	if o.ReportLimit > 0 && len(o.Report) > o.ReportLimit {
+		return o.Report[len(o.Report)-o.ReportLimit:]
+	}
+	return o.Report
+}
+
+// WriteReport writes one row per processed file as JSON or CSV
+func (o *Organizer) WriteReport(w io.Writer, format string) error {
+	switch format {
+	case "json":
+		rows := o.reportRows()
+		if rows == nil {
+			rows = []FileReport{}
+		}
+		data, err := json.MarshalIndent(rows, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal JSON: %w", err)
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	case "csv":
+		writer := csv.NewWriter(w)
+		if err := writer.Write([]string{"action", "source", "destination", "category", "bytes", "reason", "conflict", "error"}); err != nil {
+			return err
+		}
+		for _, r := range o.reportRows() {
+			record := []string{r.Action, r.Source, r.Destination, r.Category, strconv.FormatInt(r.Bytes, 10), r.Reason, r.Conflict, r.Error}
+			if err := writer.Write(record); err != nil {
+				return err
+			}
+		}
+		writer.Flush()
+		return writer.Error()
+	default:
+		return fmt.Errorf("unsupported report format: %s", format)
+	}
+}
+
+// verifyOperation checks that the files an operation depends on are still
+// in the state they were in when the plan was made.
+func (o *Organizer) verifyOperation(op Operation) error {
+	if op.Action == SkipAction || op.Action == KeepAction {
+		return nil
+	}
+
+	if err := checkStamp(op.Source, op.SourceAt); err != nil {
+		return fmt.Errorf("source %w", err)
+	}
+
+	if op.TargetAt != nil {
+		if err := checkStamp(op.Target, *op.TargetAt); err != nil {
+			return fmt.Errorf("target %w", err)
+		}
+	} else if op.Action == ArchiveAction {
+		// Bundles are extended rather than replaced
+	} else if _, err := os.Lstat(op.Target); err == nil {
+		return fmt.Errorf("target %s was created since planning", op.Target)
+	}
+
+	return nil
+}
+
+func checkStamp(path string, want FileStamp) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return fmt.Errorf("is no longer accessible: %w", err)
+	}
+	if info.Size() != want.Size || !info.ModTime().Equal(want.ModTime) {
+		return fmt.Errorf("changed since planning")
+	}
+	return nil
+}
+
+// Save writes the plan as JSON with paths relative to the plan directory
+func (p *Plan) Save(path string) error {
+	absDir, err := filepath.Abs(p.Directory)
+	if err != nil {
+		return err
+	}
+
+	out := *p
+	out.Directory = absDir
+	out.Operations = make([]Operation, len(p.Operations))
+	for i, op := range p.Operations {
+		op.Source = relToDir(p.Directory, op.Source)
+		if op.Target != "" {
+			op.Target = relToDir(p.Directory, op.Target)
+		}
+		out.Operations[i] = op
+	}
+
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// LoadPlan reads a plan written by Save
+func LoadPlan(path string) (*Plan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var plan Plan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return nil, fmt.Errorf("invalid plan file: %w", err)
+	}
+	if plan.Directory == "" {
+		return nil, fmt.Errorf("invalid plan file: missing directory")
+	}
+
+	for i := range plan.Operations {
+		op := &plan.Operations[i]
+		op.Source = filepath.Join(plan.Directory, op.Source)
+		if op.Target != "" {
+			op.Target = filepath.Join(plan.Directory, op.Target)
+		}
+	}
+
+	return &plan, nil
+}
+
+func relToDir(dir, path string) string {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return path
+	}
+	return rel
+}
+
+func printPlanSummary(plan *Plan, path string) {
+	counts := make(map[string]int)
+	for _, op := range plan.Operations {
+		counts[op.Action]++
+	}
+
+	var actions []string
+	for action := range counts {
+		actions = append(actions, action)
+	}
+	sort.Strings(actions)
+
+	fmt.Printf("Wrote plan with %d operations to %s\n", len(plan.Operations), path)
+	for _, action := range actions {
+		fmt.Printf("  %-9s: %d\n", action, counts[action])
+	}
+	fmt.Printf("\nReview the plan, then run: %s apply %s\n", filepath.Base(os.Args[0]), path)
+}
+
+// Watch polls the directory until stop is closed, organizing each new file
+// once its size and modification time have been stable for SettleTime.
+func (o *Organizer) Watch(stop <-chan struct{}) error {
+	if err := o.checkDirectory(); err != nil {
+		return err
+	}
+
+	if o.DryRun {
+		fmt.Printf("DRY RUN: No files will be moved\n\n")
+	}
+
+	fmt.Printf("Watching: %s\n", o.Directory)
+	fmt.Printf("Method: %s\n", o.Method)
+	if o.Mode != MoveMode {
+		fmt.Printf("Placement: %s\n", o.Mode)
+	}
+	if o.Recursive {
+		fmt.Printf("Mode: Recursive\n")
+	}
+	fmt.Printf("Interval: %v, settle time: %v\n", o.PollInterval, o.SettleTime)
+	fmt.Println("\nPress Ctrl+C to stop watching...")
+	fmt.Println(strings.Repeat("-", 50))
+
+	pending := make(map[string]pendingFile)
+	// Files that were already processed (or failed) are not handled again
+	// until they change; moved files simply disappear from the scan
+	handled := make(map[string]pendingFile)
+
+	ticker := time.NewTicker(o.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		o.checkPending(pending, handled)
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+func (o *Organizer) checkPending(pending, handled map[string]pendingFile) {
+	files, err := o.scanDirectory()
+	if err != nil {
+		log.Printf("Failed to scan directory: %v", err)
+		return
+	}
+
+	now := time.Now()
+	seen := make(map[string]bool, len(files))
+
+	for _, file := range files {
+		if partialDownloadExts[strings.ToLower(filepath.Ext(file.Path))] {
+			continue
+		}
+		seen[file.Path] = true
+
+		size, modTime := file.Info.Size(), file.Info.ModTime()
+		if h, ok := handled[file.Path]; ok && h.size == size && h.modTime.Equal(modTime) {
+			continue
+		}
+		delete(handled, file.Path)
+
+		p, ok := pending[file.Path]
+		if !ok || p.size != size || !p.modTime.Equal(modTime) {
+			if o.Verbose && !ok {
+				fmt.Printf("Detected: %s\n", file.Path)
+			}
+			pending[file.Path] = pendingFile{size: size, modTime: modTime, stableSince: now}
+			continue
+		}
+
+		if now.Sub(p.stableSince) < o.SettleTime {
+			continue
+		}
+
+		delete(pending, file.Path)
+		if err := o.organizeFile(file); err != nil {
+			log.Printf("Failed to organize %s: %v", file.Path, err)
+		}
+		handled[file.Path] = p
+	}
+
+	// Forget files that disappeared before they settled
+	for path := range pending {
+		if !seen[path] {
+			delete(pending, path)
+		}
+	}
+	for path := range handled {
+		if !seen[path] {
+			delete(handled, path)
+		}
+	}
+
+	// Directories still holding files are reconsidered once those move too
+	if o.PruneEmpty && len(o.vacated) > 0 {
+		o.pruneEmptyDirs()
+		o.vacated = nil
+	}
+}
+
+func (o *Organizer) scanDirectory() ([]FileInfo, error) {
+	var files []FileInfo
+
+	ignore := newIgnoreMatcher(o.Directory)
+	if err := ignore.load(o.Directory); err != nil {
+		return nil, err
+	}
+
+	walkFunc := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Skip hidden and ignored directories, loading ignore files from
+		// the ones that are walked
+		if info.IsDir() {
+			if filepath.Clean(path) == filepath.Clean(o.Directory) {
+				return nil
+			}
+			if strings.HasPrefix(info.Name(), ".") || ignore.ignored(path, true) {
+				return filepath.SkipDir
+			}
+			// Never pack bundles into other bundles
+			if o.Method == ByArchive && filepath.Clean(path) == filepath.Join(o.Directory, archiveDirName) {
+				return filepath.SkipDir
+			}
+			return ignore.load(path)
+		}
+
+		// Skip hidden files
+		if strings.HasPrefix(filepath.Base(path), ".") {
+			return nil
+		}
+
+		// Skip the organizer executable itself
+		if filepath.Base(path) == filepath.Base(os.Args[0]) {
+			return nil
+		}
+
+		// Skip files matched by .organizeignore rules
+		if ignore.ignored(path, false) {
+			if o.Verbose {
+				fmt.Printf("Ignoring: %s\n", path)
+			}
+			return nil
+		}
+
+		// Get file category based on organization method
+		file := FileInfo{Path: path, Info: info}
+		if o.Method == ByMusic {
+			if !isTaggedAudio(path) {
+				return nil
+			}
+			file.Tags = readAudioTags(path)
+			file.Category = o.getMusicCategory(file.Tags)
+			if file.Category == "" {
+				if o.Verbose {
+					fmt.Printf("No tags, leaving: %s\n", path)
+				}
+				return nil
+			}
+		} else {
+			file.Category = o.getFileCategory(path, info)
+		}
+
+		files = append(files, file)
+
+		return nil
+	}
+
+	if o.Recursive {
+		err := filepath.Walk(o.Directory, walkFunc)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		entries, err := os.ReadDir(o.Directory)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+
+			path := filepath.Join(o.Directory, entry.Name())
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+
+			if err := walkFunc(path, info, nil); err != nil {
+				continue
+			}
+		}
+	}
+
+	return files, nil
+}
+
+func newIgnoreMatcher(root string) *ignoreMatcher {
+	return &ignoreMatcher{root: root, rules: make(map[string][]ignoreRule)}
+}
+
+// load reads the ignore file in dir, if there is one
+func (m *ignoreMatcher) load(dir string) error {
+	f, err := os.Open(filepath.Join(dir, ignoreFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	key := m.relative(dir)
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		rule, ok, err := parseIgnoreLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s line %d: %w", filepath.Join(dir, ignoreFileName), lineNum, err)
+		}
+		if ok {
+			m.rules[key] = append(m.rules[key], rule)
+		}
+	}
+	return scanner.Err()
+}
+
+func (m *ignoreMatcher) relative(path string) string {
+	rel, err := filepath.Rel(m.root, path)
+	if err != nil || rel == "." {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+// ignored reports whether path is excluded. As in git, the last matching
+// rule wins and rules from deeper directories are checked after their parents.
+func (m *ignoreMatcher) ignored(path string, isDir bool) bool {
+	rel := m.relative(path)
+	if rel == "" {
+		return false
+	}
+
+	ignored := false
+	dir := ""
+	for {
+		sub := rel
+		if dir != "" {
+			sub = strings.TrimPrefix(rel, dir+"/")
+		}
+		for _, rule := range m.rules[dir] {
+			if rule.dirOnly && !isDir {
+				continue
+			}
+			if rule.pattern.MatchString(sub) {
+				ignored = !rule.negate
+			}
+		}
+
+		// Descend one directory towards the path
+		next := strings.IndexByte(sub, '/')
+		if next < 0 {
+			return ignored
+		}
+		if dir == "" {
+			dir = sub[:next]
+		} else {
+			dir += "/" + sub[:next]
+		}
+	}
+}
+
+// parseIgnoreLine turns one line of an ignore file into a rule; ok is false
+// for blank lines and comments.
+func parseIgnoreLine(line string) (rule ignoreRule, ok bool, err error) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return rule, false, nil
+	}
+
+	switch {
+	case strings.HasPrefix(line, "!"):
+		rule.negate = true
+		line = line[1:]
+	case strings.HasPrefix(line, `\!`), strings.HasPrefix(line, `\#`):
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return rule, false, nil
+	}
+
+	// Patterns containing a slash are relative to the ignore file's
+	// directory; others match a name at any depth below it
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+
+	var re strings.Builder
+	re.WriteString("^")
+	if !anchored {
+		re.WriteString("(?:.*/)?")
+	}
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case strings.HasPrefix(line[i:], "**/") && (i == 0 || line[i-1] == '/'):
+			re.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(line[i:], "**") && i+2 == len(line) && (i == 0 || line[i-1] == '/'):
+			re.WriteString(".*")
+			i++
+		case c == '*':
+			re.WriteString("[^/]*")
+		case c == '?':
+			re.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(line[i+1:], ']')
+			if end < 0 {
+				return rule, false, fmt.Errorf("unclosed '[' in %q", line)
+			}
+			class := line[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(line):
+			i++
+			re.WriteString(regexp.QuoteMeta(string(line[i])))
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+
+	rule.pattern, err = regexp.Compile(re.String())
+	if err != nil {
+		return rule, false, fmt.Errorf("invalid pattern %q: %w", line, err)
+	}
+	return rule, true, nil
+}
+
+func (o *Organizer) getFileCategory(path string, info os.FileInfo) string {
+	switch o.Method {
+	case ByType:
+		return o.getTypeCategory(path)
+	case BySize:
+		return o.getSizeCategory(info.Size())
+	case ByDate:
+		return o.getDateCategory(info.ModTime())
+	case ByArchive:
+		return info.ModTime().Format("2006-01")
+	default:
+		return "Other"
+	}
+}
+
+func (o *Organizer) getTypeCategory(path string) string {
+	ext := strings.ToLower(filepath.Ext(path))
+
+	// Image files
+	imageExts := map[string]bool{
+		".jpg": true, ".jpeg": true, ".png": true, ".gif": true,
+		".bmp": true, ".tiff": true, ".webp": true, ".svg": true,
+	}
+	if imageExts[ext] {
+		return "Images"
+	}
+
+	// Document files
+	docExts := map[string]bool{
+		".pdf": true, ".doc": true, ".docx": true, ".txt": true,
+		".rtf": true, ".odt": true, ".pages": true,
+	}
+	if docExts[ext] {
+		return "Documents"
+	}
+
+	// Video files
+	videoExts := map[string]bool{
+		".mp4": true, ".avi": true, ".mkv": true, ".mov": true,
+		".wmv": true, ".flv": true, ".webm": true, ".m4v": true,
+	}
+	if videoExts[ext] {
+		return "Videos"
+	}
+
+	// Audio files
+	audioExts := map[string]bool{
+		".mp3": true, ".wav": true, ".flac": true, ".aac": true,
+		".ogg": true, ".wma": true, ".m4a": true,
+	}
+	if audioExts[ext] {
+		return "Audio"
+	}
+
+	// Archive files
+	archiveExts := map[string]bool{
+		".zip": true, ".rar": true, ".7z": true, ".tar": true,
+		".gz": true, ".bz2": true, ".xz": true,
+	}
+	if archiveExts[ext] {
+		return "Archives"
+	}
+
+	// Code files
+	codeExts := map[string]bool{
+		".go": true, ".js": true, ".py": true, ".java": true,
+		".cpp": true, ".c": true, ".h": true, ".html": true,
+		".css": true, ".php": true, ".rb": true, ".swift": true,
+		".rs": true, ".ts": true, ".jsx": true, ".tsx": true,
+	}
+	if codeExts[ext] {
+		return "Code"
+	}
+
+	return "Other"
+}
+
+// getMusicCategory returns the Artist/Album directory for an audio file, the
+// fallback directory when it has no usable tags, or "" to leave it alone.
+func (o *Organizer) getMusicCategory(tags *AudioTags) string {
+	if tags == nil || (tags.albumArtist() == "" && tags.Album == "" && tags.Title == "") {
+		if o.MusicFallback == skipFallback {
+			return ""
+		}
+		return o.MusicFallback
+	}
+
+	artist := pathSafe(tags.albumArtist(), "Unknown Artist")
+	album := pathSafe(tags.Album, "Unknown Album")
+	return filepath.Join(artist, album)
+}
+
+// musicFileName builds "NN - Title.ext" from the tags, keeping the original
+// name for files without a title.
+func musicFileName(file FileInfo) string {
+	original := filepath.Base(file.Path)
+	if file.Tags == nil || file.Tags.Title == "" {
+		return original
+	}
+
+	name := pathSafe(file.Tags.Title, strings.TrimSuffix(original, filepath.Ext(original)))
+	if file.Tags.Track > 0 {
+		name = fmt.Sprintf("%02d - %s", file.Tags.Track, name)
+	}
+	return name + strings.ToLower(filepath.Ext(original))
+}
+
+func (t *AudioTags) albumArtist() string {
+	if t.AlbumArtist != "" {
+		return t.AlbumArtist
+	}
+	return t.Artist
+}
+
+func tagField(tags *AudioTags, field string, width int) string {
+	if tags == nil {
+		return ""
+	}
+	switch field {
+	case "artist":
+		return pathSafe(tags.Artist, "")
+	case "album":
+		return pathSafe(tags.Album, "")
+	case "title":
+		return pathSafe(tags.Title, "")
+	case "track":
+		if tags.Track > 0 {
+			return fmt.Sprintf("%0*d", width, tags.Track)
+		}
+	}
+	return ""
+}
+
+// pathSafe makes a tag value usable as a single path element
+func pathSafe(value, fallback string) string {
+	value = collapseWhitespace(stripUnsafe(value))
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+func isTaggedAudio(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mp3", ".flac", ".ogg", ".oga", ".opus":
+		return true
+	}
+	return false
+}
+
+// readAudioTags reads ID3v2/ID3v1 tags from MP3 files and Vorbis comments
+// from FLAC and Ogg files. It returns nil when no tags can be found.
+func readAudioTags(path string) *AudioTags {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var tags *AudioTags
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mp3":
+		tags = readID3v2(f)
+		if v1 := readID3v1(f); v1 != nil {
+			tags = mergeTags(tags, v1)
+		}
+	case ".flac":
+		tags = readFLACTags(f)
+	default:
+		tags = readOggTags(f)
+	}
+	return tags
+}
+
+func mergeTags(primary, secondary *AudioTags) *AudioTags {
+	if primary == nil {
+		return secondary
+	}
+	if primary.Title == "" {
+		primary.Title = secondary.Title
+	}
+	if primary.Artist == "" {
+		primary.Artist = secondary.Artist
+	}
+	if primary.Album == "" {
+		primary.Album = secondary.Album
+	}
+	if primary.Track == 0 {
+		primary.Track = secondary.Track
+	}
+	return primary
+}
+
+// Largest tag block read into memory; larger tags are mostly cover art
+const maxTagSize = 16 << 20
+
+func readID3v2(r io.ReadSeeker) *AudioTags {
+	header := make([]byte, 10)
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil
+	}
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:3]) != "ID3" {
+		return nil
+	}
+
+	version, flags := header[3], header[5]
+	size := syncsafe(header[6:10])
+	if version < 2 || version > 4 || size > maxTagSize {
+		return nil
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil
+	}
+	if flags&0x80 != 0 && version < 4 {
+		data = removeUnsync(data)
+	}
+
+	// Skip the extended header
+	if flags&0x40 != 0 && version >= 3 && len(data) >= 4 {
+		extSize := int(binary.BigEndian.Uint32(data[:4]))
+		if version == 4 {
+			extSize = syncsafe(data[:4])
+		} else {
+			extSize += 4
+		}
+		if extSize > len(data) {
+			return nil
+		}
+		data = data[extSize:]
+	}
+
+	idLen, headerLen := 4, 10
+	if version == 2 {
+		idLen, headerLen = 3, 6
+	}
+
+	tags := &AudioTags{}
+	for len(data) >= headerLen && data[0] != 0 {
+		id := string(data[:idLen])
+		var frameSize int
+		switch version {
+		case 2:
+			frameSize = int(data[3])<<16 | int(data[4])<<8 | int(data[5])
+		case 3:
+			frameSize = int(binary.BigEndian.Uint32(data[4:8]))
+		default:
+			frameSize = syncsafe(data[4:8])
+		}
+		if frameSize < 0 || headerLen+frameSize > len(data) {
+			break
+		}
+
+		body := data[headerLen : headerLen+frameSize]
+		if version == 4 {
+			var ok bool
+			if body, ok = id3v24FrameBody(body, data[9], flags&0x80 != 0); !ok {
+				data = data[headerLen+frameSize:]
+				continue
+			}
+		}
+
+		switch id {
+		case "TIT2", "TT2":
+			tags.Title = id3Text(body)
+		case "TPE1", "TP1":
+			tags.Artist = id3Text(body)
+		case "TPE2", "TP2":
+			tags.AlbumArtist = id3Text(body)
+		case "TALB", "TAL":
+			tags.Album = id3Text(body)
+		case "TRCK", "TRK":
+			tags.Track = parseTrack(id3Text(body))
+		}
+
+		data = data[headerLen+frameSize:]
+	}
+
+	if *tags == (AudioTags{}) {
+		return nil
+	}
+	return tags
+}
+
+// id3v24FrameBody strips the extra bytes an ID3v2.4 frame's format flags
+// put before its data (group id, encryption method, data length indicator)
+// and undoes its unsynchronisation. Compressed and encrypted frames are not
+// decoded.
+func id3v24FrameBody(body []byte, frameFlags byte, tagUnsync bool) ([]byte, bool) {
+	if frameFlags&0x0c != 0 {
+		return nil, false
+	}
+	if frameFlags&0x40 != 0 {
+		if len(body) < 1 {
+			return nil, false
+		}
+		body = body[1:]
+	}
+	if frameFlags&0x01 != 0 {
+		if len(body) < 4 {
+			return nil, false
+		}
+		body = body[4:]
+	}
+	if frameFlags&0x02 != 0 || tagUnsync {
+		body = removeUnsync(body)
+	}
+	return body, true
+}
+
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+// removeUnsync reverses ID3 unsynchronisation (0xFF 0x00 -> 0xFF)
+func removeUnsync(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		out = append(out, b[i])
+		if b[i] == 0xff && i+1 < len(b) && b[i+1] == 0x00 {
+			i++
+		}
+	}
+	return out
+}
+
+// id3Text decodes a text frame, returning its first value
+func id3Text(body []byte) string {
+	if len(body) < 1 {
+		return ""
+	}
+
+	var text string
+	encoding, raw := body[0], body[1:]
+	switch encoding {
+	case 0:
+		text = latin1(raw)
+	case 1, 2:
+		text = decodeUTF16(raw, encoding == 2)
+	default:
+		text = string(raw)
+	}
+
+	if i := strings.IndexByte(text, 0); i >= 0 {
+		text = text[:i]
+	}
+	return strings.TrimSpace(text)
+}
+
+func latin1(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+// decodeUTF16 decodes UTF-16 text, honouring a byte order mark if present
+func decodeUTF16(b []byte, bigEndian bool) string {
+	if len(b) >= 2 {
+		switch {
+		case b[0] == 0xff && b[1] == 0xfe:
+			bigEndian, b = false, b[2:]
+		case b[0] == 0xfe && b[1] == 0xff:
+			bigEndian, b = true, b[2:]
+		}
+	}
+
+	units := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		var u uint16
+		if bigEndian {
+			u = binary.BigEndian.Uint16(b[i:])
+		} else {
+			u = binary.LittleEndian.Uint16(b[i:])
+		}
+		if u == 0 {
+			break
+		}
+		units = append(units, u)
+	}
+	return string(utf16.Decode(units))
+}
+
+// parseTrack reads the track number from values like "3" or "03/12"
+func parseTrack(s string) int {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		s = s[:i]
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+func readID3v1(r io.ReadSeeker) *AudioTags {
+	tag := make([]byte, 128)
+	if _, err := r.Seek(-128, io.SeekEnd); err != nil {
+		return nil
+	}
+	if _, err := io.ReadFull(r, tag); err != nil || string(tag[:3]) != "TAG" {
+		return nil
+	}
+
+	field := func(b []byte) string {
+		if i := bytes.IndexByte(b, 0); i >= 0 {
+			b = b[:i]
+		}
+		return strings.TrimSpace(latin1(b))
+	}
+
+	tags := &AudioTags{
+		Title:  field(tag[3:33]),
+		Artist: field(tag[33:63]),
+		Album:  field(tag[63:93]),
+	}
+	// ID3v1.1 keeps the track number at the end of the comment
+	if tag[125] == 0 && tag[126] != 0 {
+		tags.Track = int(tag[126])
+	}
+
+	if *tags == (AudioTags{}) {
+		return nil
+	}
+	return tags
+}
+
+func readFLACTags(r io.ReadSeeker) *AudioTags {
+	// Some taggers put an ID3v2 tag in front of the FLAC stream
+	start := int64(0)
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil
+	}
+	if string(header[:3]) == "ID3" {
+		start = 10 + int64(syncsafe(header[6:10]))
+	}
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		return nil
+	}
+
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != "fLaC" {
+		return nil
+	}
+
+	for {
+		block := make([]byte, 4)
+		if _, err := io.ReadFull(r, block); err != nil {
+			return nil
+		}
+		last, blockType := block[0]&0x80 != 0, block[0]&0x7f
+		length := int(block[1])<<16 | int(block[2])<<8 | int(block[3])
+
+		if blockType == 4 {
+			data := make([]byte, length)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return nil
+			}
+			return parseVorbisComment(data)
+		}
+		if last {
+			return nil
+		}
+		if _, err := r.Seek(int64(length), io.SeekCurrent); err != nil {
+			return nil
+		}
+	}
+}
+
+// readOggTags reassembles the second packet of an Ogg stream, which holds
+// the Vorbis comment for both Vorbis and Opus audio
+func readOggTags(r io.Reader) *AudioTags {
+	br := bufio.NewReader(r)
+	var packet []byte
+	packets := 0
+	read := 0
+
+	for read < maxTagSize {
+		header := make([]byte, 27)
+		if _, err := io.ReadFull(br, header); err != nil || string(header[:4]) != "OggS" {
+			return nil
+		}
+		segments := make([]byte, header[26])
+		if _, err := io.ReadFull(br, segments); err != nil {
+			return nil
+		}
+
+		for _, segLen := range segments {
+			seg := make([]byte, segLen)
+			if _, err := io.ReadFull(br, seg); err != nil {
+				return nil
+			}
+			read += int(segLen)
+			packet = append(packet, seg...)
+			if segLen == 255 {
+				continue
+			}
+
+			// A segment shorter than 255 bytes ends the packet
+			packets++
+			if packets == 2 {
+				switch {
+				case bytes.HasPrefix(packet, []byte("\x03vorbis")):
+					return parseVorbisComment(packet[7:])
+				case bytes.HasPrefix(packet, []byte("OpusTags")):
+					return parseVorbisComment(packet[8:])
+				default:
+					return nil
+				}
+			}
+			packet = packet[:0]
+		}
+	}
+	return nil
+}
+
+func parseVorbisComment(data []byte) *AudioTags {
+	next := func() ([]byte, bool) {
+		if len(data) < 4 {
+			return nil, false
+		}
+		n := int(binary.LittleEndian.Uint32(data[:4]))
+		if n < 0 || 4+n > len(data) {
+			return nil, false
+		}
+		value := data[4 : 4+n]
+		data = data[4+n:]
+		return value, true
+	}
+
+	// Vendor string
+	if _, ok := next(); !ok || len(data) < 4 {
+		return nil
+	}
+	count := int(binary.LittleEndian.Uint32(data[:4]))
+	data = data[4:]
+
+	tags := &AudioTags{}
+	for i := 0; i < count; i++ {
+		comment, ok := next()
+		if !ok {
+			break
+		}
+		key, value, found := strings.Cut(string(comment), "=")
+		if !found {
+			continue
+		}
+		value = strings.TrimSpace(value)
+
+		switch strings.ToUpper(key) {
+		case "TITLE":
+			tags.Title = firstNonEmpty(tags.Title, value)
+		case "ARTIST":
+			tags.Artist = firstNonEmpty(tags.Artist, value)
+		case "ALBUMARTIST", "ALBUM ARTIST":
+			tags.AlbumArtist = firstNonEmpty(tags.AlbumArtist, value)
+		case "ALBUM":
+			tags.Album = firstNonEmpty(tags.Album, value)
+		case "TRACKNUMBER":
+			if tags.Track == 0 {
+				tags.Track = parseTrack(value)
+			}
+		}
+	}
+
+	if *tags == (AudioTags{}) {
+		return nil
+	}
+	return tags
+}
+
+func firstNonEmpty(current, value string) string {
+	if current != "" {
+		return current
+	}
+	return value
+}
+
+func (o *Organizer) getSizeCategory(size int64) string {
+	const (
+		MB = 1024 * 1024
+		KB = 1024
+	)
+
+	switch {
+	case size < 100*KB:
+		return "Small"
+	case size < 10*MB:
+		return "Medium"
+	default:
+		return "Large"
+	}
+}
+
+func (o *Organizer) getDateCategory(modTime time.Time) string {
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	thisWeek := today.AddDate(0, 0, -7)
+	thisMonth := today.AddDate(0, -1, 0)
+
+	switch {
+	case modTime.After(today):
+		return "Today"
+	case modTime.After(thisWeek):
+		return "This Week"
+	case modTime.After(thisMonth):
+		return "This Month"
+	default:
+		return "Older"
+	}
+}
+
+// RenameTemplate builds new file names from fields such as {name}, {ext},
+// {date:2006-01-02} and {seq:3}, each optionally piped through filters
+// like {name|slug}.
+type RenameTemplate struct {
+	source string
+	parts  []templatePart
+}
+
+type templatePart struct {
+	literal string
+	field   string
+	arg     string
+	filters []string
+}
+
+var renameFilters = map[string]func(string) string{
+	"lower":    strings.ToLower,
+	"upper":    strings.ToUpper,
+	"ascii":    transliterate,
+	"safe":     stripUnsafe,
+	"collapse": collapseWhitespace,
+	"trim":     strings.TrimSpace,
+	"slug":     slugify,
+}
+
+// Common Latin characters and their ASCII spellings
+var transliterations = map[rune]string{
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'ā': "a", 'ą': "a",
+	'À': "A", 'Á': "A", 'Â': "A", 'Ã': "A", 'Ä': "A", 'Å': "A", 'Ā': "A", 'Ą': "A",
+	'æ': "ae", 'Æ': "AE", 'ç': "c", 'Ç': "C", 'ć': "c", 'Ć': "C", 'č': "c", 'Č': "C",
+	'ď': "d", 'Ď': "D", 'ð': "d", 'Ð': "D",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ē': "e", 'ę': "e", 'ě': "e",
+	'È': "E", 'É': "E", 'Ê': "E", 'Ë': "E", 'Ē': "E", 'Ę': "E", 'Ě': "E",
+	'ğ': "g", 'Ğ': "G",
+	'ì': "i", 'í': "i", 'î': "i", 'ï': "i", 'ı': "i", 'Ì': "I", 'Í': "I", 'Î': "I", 'Ï': "I", 'İ': "I",
+	'ł': "l", 'Ł': "L", 'ñ': "n", 'Ñ': "N", 'ń': "n", 'Ń': "N", 'ň': "n", 'Ň': "N",
+	'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o", 'ø': "o", 'ő': "o",
+	'Ò': "O", 'Ó': "O", 'Ô': "O", 'Õ': "O", 'Ö': "O", 'Ø': "O", 'Ő': "O",
+	'œ': "oe", 'Œ': "OE", 'ř': "r", 'Ř': "R",
+	'ś': "s", 'Ś': "S", 'š': "s", 'Š': "S", 'ş': "s", 'Ş': "S", 'ß': "ss",
+	'ť': "t", 'Ť': "T", 'þ': "th", 'Þ': "TH",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "u", 'ů': "u", 'ű': "u",
+	'Ù': "U", 'Ú': "U", 'Û': "U", 'Ü': "U", 'Ů': "U", 'Ű': "U",
+	'ý': "y", 'ÿ': "y", 'Ý': "Y", 'ź': "z", 'Ź': "Z", 'ż': "z", 'Ż': "Z", 'ž': "z", 'Ž': "Z",
+	'‘': "'", '’': "'", '“': "\"", '”': "\"", '–': "-", '—': "-", '…': "...",
+}
+
+// ParseRenameTemplate validates a template once so it can be rendered for
+// every file.
+func ParseRenameTemplate(s string) (*RenameTemplate, error) {
+	t := &RenameTemplate{source: s}
+	rest := s
+
+	for rest != "" {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			t.parts = append(t.parts, templatePart{literal: rest})
+			break
+		}
+		if open > 0 {
+			t.parts = append(t.parts, templatePart{literal: rest[:open]})
+		}
+
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed '{' in %q", s)
+		}
+
+		part, err := parseTemplateField(rest[open+1 : open+end])
+		if err != nil {
+			return nil, err
+		}
+		t.parts = append(t.parts, part)
+		rest = rest[open+end+1:]
+	}
+
+	if strings.ContainsAny(strings.Join(t.literals(), ""), `/\`) {
+		return nil, fmt.Errorf("template must not contain path separators")
+	}
+
+	return t, nil
+}
+
+func parseTemplateField(spec string) (templatePart, error) {
+	pieces := strings.Split(spec, "|")
+	field, arg, _ := strings.Cut(pieces[0], ":")
+	part := templatePart{field: strings.TrimSpace(field), arg: arg}
+
+	switch part.field {
+	case "name", "ext", "category", "artist", "album", "title":
+		if arg != "" {
+			return part, fmt.Errorf("field {%s} does not take an argument", part.field)
+		}
+	case "date":
+		if part.arg == "" {
+			part.arg = "2006-01-02"
+		}
+	case "seq", "track":
+		if part.arg != "" {
+			if width, err := strconv.Atoi(part.arg); err != nil || width < 1 {
+				return part, fmt.Errorf("invalid {%s} width %q", part.field, part.arg)
+			}
+		}
+	default:
+		return part, fmt.Errorf("unknown field {%s}", part.field)
+	}
+
+	for _, filter := range pieces[1:] {
+		filter = strings.TrimSpace(filter)
+		if _, ok := renameFilters[filter]; !ok {
+			return part, fmt.Errorf("unknown filter %q in {%s}", filter, spec)
+		}
+		part.filters = append(part.filters, filter)
+	}
+
+	return part, nil
+}
+
+func (t *RenameTemplate) literals() []string {
+	var out []string
+	for _, part := range t.parts {
+		if part.field == "" {
+			out = append(out, part.literal)
+		}
+	}
+	return out
+}
+
+func (t *RenameTemplate) String() string {
+	return t.source
+}
+
+// Render produces the new name for a file; seq is the file's position
+// within its category. The original name is kept if the result is empty.
+func (t *RenameTemplate) Render(file FileInfo, seq int) string {
+	original := filepath.Base(file.Path)
+	ext := filepath.Ext(original)
+
+	var b strings.Builder
+	for _, part := range t.parts {
+		if part.field == "" {
+			b.WriteString(part.literal)
+			continue
+		}
+
+		var value string
+		switch part.field {
+		case "name":
+			value = strings.TrimSuffix(original, ext)
+		case "ext":
+			value = ext
+		case "category":
+			value = file.Category
+		case "date":
+			value = file.Info.ModTime().Format(part.arg)
+		case "seq":
+			value = fmt.Sprintf("%0*d", atoiOr(part.arg, 1), seq)
+		case "artist", "album", "title", "track":
+			value = tagField(file.Tags, part.field, atoiOr(part.arg, 1))
+		}
+
+		for _, filter := range part.filters {
+			value = renameFilters[filter](value)
+		}
+		b.WriteString(value)
+	}
+
+	// Path separators produced by fields or date layouts are never allowed
+	name := strings.NewReplacer("/", "_", "\\", "_").Replace(b.String())
+	if strings.Trim(name, ". ") == "" {
+		return original
+	}
+	return name
+}
+
+func atoiOr(s string, fallback int) int {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fallback
+	}
+	return n
+}
+
+// transliterate spells common accented characters in ASCII and drops any
+// other non-ASCII characters
+func transliterate(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r < unicode.MaxASCII:
+			b.WriteRune(r)
+		case transliterations[r] != "":
+			b.WriteString(transliterations[r])
+		case unicode.IsSpace(r):
+			b.WriteByte(' ')
+		}
+	}
+	return b.String()
+}
+
+// stripUnsafe removes characters that are invalid on common file systems
+// or awkward in shell scripts
+func stripUnsafe(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`<>:"/\|?*`, r) {
+			return -1
+		}
+		return r
+	}, s)
+	return strings.Trim(s, ". ")
+}
+
+func collapseWhitespace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// slugify produces lowercase ASCII words joined by hyphens
+func slugify(s string) string {
+	s = strings.ToLower(transliterate(s))
+
+	var b strings.Builder
+	pendingDash := false
+	for _, r := range s {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if pendingDash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			pendingDash = false
+			b.WriteRune(r)
+			continue
+		}
+		pendingDash = true
+	}
+	return b.String()
+}
+
+func (o *Organizer) organizeFile(file FileInfo) error {
+	defer o.flushArchives()
+
+	for _, op := range o.planFiles([]FileInfo{file}) {
+		if !o.runOperation(op, false) {
+			return fmt.Errorf("%s failed", op.Action)
+		}
+	}
+	return nil
+}
+
+// planFile decides what should happen to a single file. Files that need no
+// change get a skip operation saying why.
+func (o *Organizer) planFile(file FileInfo) (*Operation, error) {
+	if o.Method == ByArchive {
+		return o.planArchive(file), nil
+	}
+
+	targetDir := filepath.Join(o.Directory, file.Category)
+
+	// Files already in their category directory are left alone
+	if filepath.Clean(filepath.Dir(file.Path)) == filepath.Clean(targetDir) {
+		return skipOperation(file, "already in "+file.Category), nil
+	}
+
+	// Links created by a previous symlink run are not organized again
+	if o.Mode == SymlinkMode && file.Info.Mode()&os.ModeSymlink != 0 {
+		return skipOperation(file, "link left by a previous symlink run"), nil
+	}
+
+	op := &Operation{
+		Action:   string(o.Mode),
+		Source:   file.Path,
+		Category: file.Category,
+		Reason:   o.categoryReason(file),
+		SourceAt: FileStamp{Size: file.Info.Size(), ModTime: file.Info.ModTime()},
+	}
+
+	// Determine target file path
+	name := filepath.Base(file.Path)
+	if o.Method == ByMusic && o.Rename == nil {
+		if renamed := musicFileName(file); renamed != name {
+			op.Reason += fmt.Sprintf("; renamed from %q", name)
+			name = renamed
+		}
+	}
+	if o.Rename != nil {
+		if o.sequences == nil {
+			o.sequences = make(map[string]int)
+		}
+		o.sequences[file.Category]++
+		if renamed := o.Rename.Render(file, o.sequences[file.Category]); renamed != name {
+			op.Reason += fmt.Sprintf("; renamed from %q", name)
+			name = renamed
+		}
+	}
+	targetPath := filepath.Join(targetDir, name)
+
+	// Handle file name conflicts
+	if o.targetTaken(targetPath) {
+		existing, err := o.findExistingPlacement(file.Path, targetPath)
+		if err != nil {
+			return nil, err
+		}
+		if existing != "" {
+			op.Action = KeepAction
+			op.Target = existing
+			if o.Mode == CopyMode {
+				op.Reason += "; copy is already up to date"
+			} else {
+				op.Reason += "; link is already up to date"
+			}
+			return op, nil
+		}
+
+		if err := o.resolveConflict(file, targetPath, op); err != nil {
+			return nil, err
+		}
+		return op, nil
+	}
+
+	op.Target = targetPath
+	o.reserve(op)
+	return op, nil
+}
+
+func skipOperation(file FileInfo, reason string) *Operation {
+	return &Operation{
+		Action:   SkipAction,
+		Source:   file.Path,
+		Category: file.Category,
+		Reason:   reason,
+		SourceAt: FileStamp{Size: file.Info.Size(), ModTime: file.Info.ModTime()},
+	}
+}
+
+func (o *Organizer) categoryReason(file FileInfo) string {
+	switch o.Method {
+	case ByType:
+		ext := strings.ToLower(filepath.Ext(file.Path))
+		if ext == "" {
+			ext = "none"
+		}
+		return fmt.Sprintf("extension %s is %s", ext, file.Category)
+	case BySize:
+		return fmt.Sprintf("size %d bytes is %s", file.Info.Size(), file.Category)
+	case ByDate:
+		return fmt.Sprintf("modified %s is %s", file.Info.ModTime().Format("2006-01-02"), file.Category)
+	case ByArchive:
+		return fmt.Sprintf("modified %s, more than %d days ago", file.Info.ModTime().Format("2006-01-02"), int(o.ArchiveAge.Hours()/24))
+	case ByMusic:
+		if file.Tags == nil {
+			return "no audio tags, using fallback " + file.Category
+		}
+		return fmt.Sprintf("tagged %q / %q", file.Tags.albumArtist(), file.Tags.Album)
+	default:
+		return fmt.Sprintf("unknown method %s", o.Method)
+	}
+}
+
+func (o *Organizer) targetTaken(path string) bool {
+	if o.reserved[path] != nil {
+		return true
+	}
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+func (o *Organizer) reserve(op *Operation) {
+	if o.reserved != nil && op.Target != "" {
+		o.reserved[op.Target] = op
+	}
+}
+
+// applyOperation carries out a planned operation, or describes it in a dry run
+func (o *Organizer) applyOperation(op Operation) error {
+	relPath, _ := filepath.Rel(o.Directory, op.Source)
+	targetRelPath, _ := filepath.Rel(o.Directory, op.Target)
+
+	if op.Conflict != "" {
+		o.recordConflict(op)
+	}
+
+	switch op.Action {
+	case SkipAction:
+		return nil
+	case KeepAction:
+		if o.Verbose {
+			fmt.Printf("Up to date: %s\n", targetRelPath)
+		}
+		o.countFile(op.Category)
+		return nil
+	case RemoveAction:
+		if o.DryRun {
+			fmt.Printf("Would remove duplicate: %s\n", relPath)
+		} else {
+			if o.Verbose {
+				fmt.Printf("Removing duplicate: %s\n", relPath)
+			}
+			if err := os.Remove(op.Source); err != nil {
+				return fmt.Errorf("failed to remove duplicate: %w", err)
+			}
+		}
+		o.noteVacated(op.Source)
+		return nil
+	case ArchiveAction:
+		if o.DryRun {
+			fmt.Printf("Would archive: %s -> %s\n", relPath, targetRelPath)
+			o.countFile(op.Category)
+			return nil
+		}
+		o.mu.Lock()
+		if o.archiveQueue == nil {
+			o.archiveQueue = make(map[string][]Operation)
+		}
+		o.archiveQueue[op.Target] = append(o.archiveQueue[op.Target], op)
+		o.mu.Unlock()
+		return nil
+	case FlattenAction:
+		if o.DryRun {
+			fmt.Printf("Would flatten: %s -> %s\n", relPath, targetRelPath)
+		} else {
+			if o.Verbose {
+				fmt.Printf("Flattening: %s -> %s\n", relPath, targetRelPath)
+			}
+			if err := os.Rename(op.Source, op.Target); err != nil {
+				return fmt.Errorf("failed to flatten file: %w", err)
+			}
+		}
+		o.noteVacated(op.Source)
+		return nil
+	}
+
+	if o.DryRun {
+		fmt.Printf("Would %s: %s -> %s\n", op.Action, relPath, targetRelPath)
+		if from, to := filepath.Base(op.Source), filepath.Base(op.Target); from != to {
+			fmt.Printf("    name: %q -> %q\n", from, to)
+		}
+	} else {
+		if o.Verbose {
+			fmt.Printf("%s: %s -> %s\n", actionLabel(op.Action), relPath, targetRelPath)
+		}
+
+		// Create target directory
+		targetDir := filepath.Dir(op.Target)
+		if err := os.MkdirAll(targetDir, 0755); err != nil {
+			return fmt.Errorf("failed to create directory %s: %w", targetDir, err)
+		}
+
+		if err := placeFile(op); err != nil {
+			return fmt.Errorf("failed to %s file: %w", op.Action, err)
+		}
+	}
+
+	if PlacementMode(op.Action) == MoveMode {
+		o.noteVacated(op.Source)
+	}
+
+	// Update statistics
+	o.countFile(op.Category)
+
+	return nil
+}
+
+func (o *Organizer) countFile(category string) {
+	o.mu.Lock()
+	o.Stats[category]++
+	o.mu.Unlock()
+}
+
+func (o *Organizer) recordConflict(op Operation) {
+	action := op.Conflict
+	if o.DryRun {
+		action += " (dry run)"
+	}
+
+	o.mu.Lock()
+	o.Conflicts = append(o.Conflicts, ConflictDecision{Source: op.Source, Target: op.Target, Action: action})
+	o.mu.Unlock()
+	if o.Verbose || o.DryRun {
+		relPath, _ := filepath.Rel(o.Directory, op.Source)
+		fmt.Printf("Conflict: %s: %s\n", relPath, action)
+	}
+}
+
+// resolveConflict applies the configured strategy to a file whose target path
+// is already taken, filling in the operation's action, target and conflict
+// description.
+func (o *Organizer) resolveConflict(file FileInfo, targetPath string, op *Operation) error {
+	op.Target = targetPath
+	rename := func(reason string) error {
+		unique := o.getUniqueFilename(targetPath)
+		relPath, _ := filepath.Rel(o.Directory, unique)
+		op.Conflict = reason + "renamed to " + relPath
+		op.Target = unique
+		o.reserve(op)
+		return nil
+	}
+	skip := func(reason string) error {
+		op.Action = SkipAction
+		op.Conflict = reason
+		return nil
+	}
+
+	// Under keep-newer and keep-larger, a file planned for the same target
+	// earlier is compared with this one rather than with the file on disk
+	claim := o.reserved[targetPath]
+	if claim != nil && claim.Action == string(o.Mode) &&
+		(o.OnConflict == KeepNewerOnConflict || o.OnConflict == KeepLargerOnConflict) {
+		o.contestClaim(file, claim, op)
+		return nil
+	}
+
+	existing, err := os.Stat(targetPath)
+	if err != nil || claim != nil {
+		// Dangling links, unreadable targets and targets claimed earlier in
+		// the same plan fall back to renaming
+		return rename("")
+	}
+	if info, err := os.Lstat(targetPath); err == nil {
+		op.TargetAt = &FileStamp{Size: info.Size(), ModTime: info.ModTime()}
+	}
+
+	switch o.OnConflict {
+	case SkipOnConflict:
+		return skip("skipped")
+	case OverwriteOnConflict:
+		op.Conflict = "overwritten"
+		op.Overwrite = true
+		o.reserve(op)
+		return nil
+	case KeepNewerOnConflict:
+		if file.Info.ModTime().After(existing.ModTime()) {
+			op.Conflict = "replaced older existing file"
+			op.Overwrite = true
+			o.reserve(op)
+			return nil
+		}
+		return skip("skipped (existing file is newer)")
+	case KeepLargerOnConflict:
+		if file.Info.Size() > existing.Size() {
+			op.Conflict = "replaced smaller existing file"
+			op.Overwrite = true
+			o.reserve(op)
+			return nil
+		}
+		return skip("skipped (existing file is larger)")
+	case DedupeOnConflict:
+		same, err := sameContent(file.Path, targetPath)
+		if err != nil {
+			return fmt.Errorf("failed to compare with %s: %w", targetPath, err)
+		}
+		if !same {
+			op.TargetAt = nil
+			return rename("content differs, ")
+		}
+		// Only a moved file is removed; copy and link modes leave originals alone
+		if o.Mode != MoveMode {
+			return skip("skipped (duplicate)")
+		}
+		op.Action = RemoveAction
+		op.Conflict = "removed (duplicate)"
+		return nil
+	default:
+		op.TargetAt = nil
+		return rename("")
+	}
+}
+
+// contestClaim settles two incoming files planned for the same target under
+// keep-newer or keep-larger. The better one takes the target, along with
+// whatever the earlier operation was going to replace; the other is skipped.
+func (o *Organizer) contestClaim(file FileInfo, claim *Operation, op *Operation) {
+	var wins bool
+	var better, worse string
+	switch o.OnConflict {
+	case KeepNewerOnConflict:
+		wins = file.Info.ModTime().After(claim.SourceAt.ModTime)
+		better, worse = "newer", "older"
+	default:
+		wins = file.Info.Size() > claim.SourceAt.Size
+		better, worse = "larger", "smaller"
+	}
+
+	op.Target = claim.Target
+	if !wins {
+		relPath, _ := filepath.Rel(o.Directory, claim.Source)
+		op.Action = SkipAction
+		op.Conflict = fmt.Sprintf("skipped (incoming %s is %s)", relPath, better)
+		return
+	}
+
+	op.Overwrite = claim.Overwrite
+	op.TargetAt = claim.TargetAt
+	op.Conflict = claim.Conflict
+	if op.Conflict == "" {
+		op.Conflict = "replaced " + worse + " incoming file"
+	}
+	o.reserve(op)
+
+	relPath, _ := filepath.Rel(o.Directory, file.Path)
+	claim.Action = SkipAction
+	claim.Overwrite = false
+	claim.TargetAt = nil
+	claim.Conflict = fmt.Sprintf("skipped (incoming %s is %s)", relPath, better)
+}
+
+// sameContent reports whether two files have identical contents
+func sameContent(a, b string) (bool, error) {
+	infoA, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	infoB, err := os.Stat(b)
+	if err != nil {
+		return false, err
+	}
+	if infoA.Size() != infoB.Size() {
+		return false, nil
+	}
+
+	hashA, err := hashFile(a)
+	if err != nil {
+		return false, err
+	}
+	hashB, err := hashFile(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(hashA, hashB), nil
+}
+
+func hashFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+func actionLabel(action string) string {
+	switch PlacementMode(action) {
+	case CopyMode:
+		return "Copying"
+	case SymlinkMode, HardlinkMode:
+		return "Linking"
+	default:
+		return "Moving"
+	}
+}
+
+// findExistingPlacement looks through targetPath and its numbered variants
+// for a copy of or link to source left by a previous run, so reruns do not
+// duplicate it.
+func (o *Organizer) findExistingPlacement(source, targetPath string) (string, error) {
+	if o.Mode == MoveMode {
+		return "", nil
+	}
+
+	ext := filepath.Ext(targetPath)
+	base := strings.TrimSuffix(targetPath, ext)
+	candidate := targetPath
+
+	for counter := 1; ; counter++ {
+		if _, err := os.Lstat(candidate); err != nil {
+			return "", nil
+		}
+		ok, err := o.isExistingPlacement(source, candidate)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return candidate, nil
+		}
+		candidate = fmt.Sprintf("%s (%d)%s", base, counter, ext)
+	}
+}
+
+// isExistingPlacement reports whether targetPath is already the copy or
+// link this organizer would create for source.
+func (o *Organizer) isExistingPlacement(source, targetPath string) (bool, error) {
+	switch o.Mode {
+	case CopyMode:
+		info, err := os.Lstat(targetPath)
+		if err != nil || !info.Mode().IsRegular() {
+			return false, nil
+		}
+		return sameContent(source, targetPath)
+	case SymlinkMode:
+		dest, err := os.Readlink(targetPath)
+		if err != nil {
+			return false, nil
+		}
+		want, err := relativeLinkTarget(source, targetPath)
+		if err != nil {
+			return false, err
+		}
+		return dest == want, nil
+	case HardlinkMode:
+		srcInfo, err := os.Stat(source)
+		if err != nil {
+			return false, err
+		}
+		dstInfo, err := os.Lstat(targetPath)
+		if err != nil {
+			return false, nil
+		}
+		return os.SameFile(srcInfo, dstInfo), nil
+	default:
+		return false, nil
+	}
+}
+
+func placeFile(op Operation) error {
+	mode, targetPath := PlacementMode(op.Action), op.Target
+	if mode != MoveMode {
+		// Links cannot replace an existing file, and a copy must not write
+		// through an existing link, so clear the target first when replacing
+		if _, err := os.Lstat(targetPath); err == nil {
+			if err := os.Remove(targetPath); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch mode {
+	case CopyMode:
+		return copyFile(op.Source, targetPath)
+	case SymlinkMode:
+		linkTarget, err := relativeLinkTarget(op.Source, targetPath)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(linkTarget, targetPath)
+	case HardlinkMode:
+		return os.Link(op.Source, targetPath)
+	default:
+		return os.Rename(op.Source, targetPath)
+	}
+}
+
+// relativeLinkTarget returns the path of source relative to the directory
+// that will contain the link at linkPath.
+func relativeLinkTarget(source, linkPath string) (string, error) {
+	absSource, err := filepath.Abs(source)
+	if err != nil {
+		return "", err
+	}
+	absLinkDir, err := filepath.Abs(filepath.Dir(linkPath))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Rel(absLinkDir, absSource)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	// Keep the modification time so date-based categories stay stable
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
 
-	switch {
-	case size < 100*KB:
-		return "Small"
-	case size < 10*MB:
-		return "Medium"
-	default:
-		return "Large"
+func (o *Organizer) getUniqueFilename(path string) string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	counter := 1
+
+	for {
+		newPath := fmt.Sprintf("%s (%d)%s", base, counter, ext)
+		if !o.targetTaken(newPath) {
+			return newPath
+		}
+		counter++
 	}
 }
 
-func (o *Organizer) getDateCategory(modTime time.Time) string {
-	now := time.Now()
-	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
-	thisWeek := today.AddDate(0, 0, -7)
-	thisMonth := today.AddDate(0, -1, 0)
+// planArchive queues a file for its monthly bundle once it is older than
+// ArchiveAge. Newer files are left where they are.
+func (o *Organizer) planArchive(file FileInfo) *Operation {
+	if time.Since(file.Info.ModTime()) < o.ArchiveAge {
+		return skipOperation(file, fmt.Sprintf("modified %s, less than %d days ago",
+			file.Info.ModTime().Format("2006-01-02"), int(o.ArchiveAge.Hours()/24)))
+	}
 
-	switch {
-	case modTime.After(today):
-		return "Today"
-	case modTime.After(thisWeek):
-		return "This Week"
-	case modTime.After(thisMonth):
-		return "This Month"
-	default:
-		return "Older"
+	bundle := filepath.Join(o.Directory, archiveDirName, file.Category+o.ArchiveExt)
+	return &Operation{
+		Action:   ArchiveAction,
+		Source:   file.Path,
+		Target:   bundle,
+		Category: file.Category,
+		Reason:   o.categoryReason(file),
+		SourceAt: FileStamp{Size: file.Info.Size(), ModTime: file.Info.ModTime()},
 	}
 }
 
-func (o *Organizer) organizeFile(file FileInfo) error {
-	// Create target directory
-	targetDir := filepath.Join(o.Directory, file.Category)
-	if err := os.MkdirAll(targetDir, 0755); err != nil {
-		return fmt.Errorf("failed to create directory %s: %w", targetDir, err)
+// flushArchives writes every queued bundle. Originals are removed only once
+// the bundle has been written and read back successfully.
+func (o *Organizer) flushArchives() {
+	bundles := make([]string, 0, len(o.archiveQueue))
+	for bundle := range o.archiveQueue {
+		bundles = append(bundles, bundle)
 	}
+	sort.Strings(bundles)
 
-	// Determine target file path
-	targetPath := filepath.Join(targetDir, filepath.Base(file.Path))
+	for _, bundle := range bundles {
+		ops := o.archiveQueue[bundle]
+		delete(o.archiveQueue, bundle)
 
-	// Handle file name conflicts
-	if _, err := os.Stat(targetPath); err == nil {
-		if !o.Force {
-			targetPath = o.getUniqueFilename(targetPath)
+		relBundle, _ := filepath.Rel(o.Directory, bundle)
+		if o.Verbose {
+			fmt.Printf("Archiving %d files into %s\n", len(ops), relBundle)
+		}
+
+		if err := o.writeBundle(bundle, ops); err != nil {
+			log.Printf("Failed to write %s, originals kept: %v", relBundle, err)
+			for _, op := range ops {
+				o.recordResult(op, fmt.Errorf("bundle not written: %w", err))
+			}
+			continue
+		}
+
+		for _, op := range ops {
+			if err := os.Remove(op.Source); err != nil {
+				log.Printf("Archived %s but failed to remove it: %v", op.Source, err)
+				o.recordResult(op, fmt.Errorf("archived but not removed: %w", err))
+				continue
+			}
+			o.noteVacated(op.Source)
+			o.countFile(op.Category)
+			o.recordResult(op, nil)
 		}
 	}
+}
 
-	// Show action
-	relPath, _ := filepath.Rel(o.Directory, file.Path)
-	targetRelPath, _ := filepath.Rel(o.Directory, targetPath)
+// bundleEntry is a file stored in a bundle together with its content hash
+type bundleEntry struct {
+	name string
+	hash string
+}
 
-	if o.DryRun {
-		fmt.Printf("Would move: %s -> %s\n", relPath, targetRelPath)
+// writeBundle adds files to a bundle, keeping anything already in it. The
+// new bundle is built in a temporary file and verified before it replaces
+// the old one.
+func (o *Organizer) writeBundle(bundle string, ops []Operation) error {
+	if err := os.MkdirAll(filepath.Dir(bundle), 0755); err != nil {
+		return err
+	}
+
+	manifest := ArchiveManifest{Bundle: filepath.Base(bundle)}
+	if _, err := os.Stat(bundle); err == nil {
+		existing, err := readManifest(bundle)
+		if err != nil {
+			return fmt.Errorf("cannot read existing bundle: %w", err)
+		}
+		manifest.Files = existing.Files
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(bundle), ".bundle-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	taken := make(map[string]bool)
+	for _, f := range manifest.Files {
+		taken[f.Name] = true
+	}
+
+	now := time.Now()
+	var added []bundleEntry
+	var files []bundleFile
+	for _, op := range ops {
+		name := uniqueEntryName(filepath.ToSlash(relToDir(o.Directory, op.Source)), taken)
+		taken[name] = true
+		files = append(files, bundleFile{name: name, path: op.Source})
+		manifest.Files = append(manifest.Files, ManifestEntry{
+			Name:       name,
+			Original:   relToDir(o.Directory, op.Source),
+			Size:       op.SourceAt.Size,
+			ModTime:    op.SourceAt.ModTime,
+			ArchivedAt: now,
+		})
+	}
+
+	if strings.HasSuffix(bundle, ".zip") {
+		added, err = writeZipBundle(tmp, bundle, files, &manifest)
 	} else {
-		if o.Verbose {
-			fmt.Printf("Moving: %s -> %s\n", relPath, targetRelPath)
+		added, err = writeTarBundle(tmp, bundle, files, &manifest)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := verifyBundle(tmpPath, added, len(manifest.Files)); err != nil {
+		return fmt.Errorf("verification failed: %w", err)
+	}
+
+	return os.Rename(tmpPath, bundle)
+}
+
+// bundleFile is a file on disk waiting to be added to a bundle
+type bundleFile struct {
+	name string
+	path string
+}
+
+func uniqueEntryName(name string, taken map[string]bool) string {
+	if !taken[name] {
+		return name
+	}
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for counter := 1; ; counter++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, counter, ext)
+		if !taken[candidate] {
+			return candidate
+		}
+	}
+}
+
+// addFiles streams each file into the bundle through create, filling in
+// the manifest hashes as it goes
+func addFiles(files []bundleFile, manifest *ArchiveManifest, create func(name string, info os.FileInfo) (io.Writer, error)) ([]bundleEntry, error) {
+	offset := len(manifest.Files) - len(files)
+	var added []bundleEntry
+
+	for i, f := range files {
+		in, err := os.Open(f.path)
+		if err != nil {
+			return nil, err
+		}
+		info, err := in.Stat()
+		if err != nil {
+			in.Close()
+			return nil, err
+		}
+
+		w, err := create(f.name, info)
+		if err != nil {
+			in.Close()
+			return nil, err
 		}
-		if err := os.Rename(file.Path, targetPath); err != nil {
-			return fmt.Errorf("failed to move file: %w", err)
+
+		h := sha256.New()
+		_, err = io.Copy(io.MultiWriter(w, h), in)
+		in.Close()
+		if err != nil {
+			return nil, err
 		}
+
+		sum := hex.EncodeToString(h.Sum(nil))
+		manifest.Files[offset+i].SHA256 = sum
+		added = append(added, bundleEntry{name: f.name, hash: sum})
 	}
 
-	// Update statistics
-	o.Stats[file.Category]++
+	return added, nil
+}
 
-	return nil
+func writeZipBundle(out io.Writer, existing string, files []bundleFile, manifest *ArchiveManifest) ([]bundleEntry, error) {
+	zw := zip.NewWriter(out)
+
+	if r, err := zip.OpenReader(existing); err == nil {
+		for _, f := range r.File {
+			if f.Name == manifestName {
+				continue
+			}
+			if err := zw.Copy(f); err != nil {
+				r.Close()
+				return nil, err
+			}
+		}
+		r.Close()
+	}
+
+	added, err := addFiles(files, manifest, func(name string, info os.FileInfo) (io.Writer, error) {
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return nil, err
+		}
+		header.Name = name
+		header.Method = zip.Deflate
+		return zw.CreateHeader(header)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	manifest.Updated = time.Now()
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: manifestName, Method: zip.Deflate, Modified: manifest.Updated})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+
+	return added, zw.Close()
 }
 
-func (o *Organizer) getUniqueFilename(path string) string {
-	ext := filepath.Ext(path)
-	base := strings.TrimSuffix(path, ext)
-	counter := 1
+func writeTarBundle(out io.Writer, existing string, files []bundleFile, manifest *ArchiveManifest) ([]bundleEntry, error) {
+	gw := gzip.NewWriter(out)
+	tw := tar.NewWriter(gw)
+
+	if f, err := os.Open(existing); err == nil {
+		err := copyTarEntries(f, tw)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	added, err := addFiles(files, manifest, func(name string, info os.FileInfo) (io.Writer, error) {
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return nil, err
+		}
+		header.Name = name
+		return tw, tw.WriteHeader(header)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	manifest.Updated = time.Now()
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	header := &tar.Header{Name: manifestName, Mode: 0644, Size: int64(len(data)), ModTime: manifest.Updated}
+	if err := tw.WriteHeader(header); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return added, gw.Close()
+}
 
+// copyTarEntries copies every entry except the manifest from a tar.gz stream
+func copyTarEntries(in io.Reader, tw *tar.Writer) error {
+	gr, err := gzip.NewReader(in)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+
+	tr := tar.NewReader(gr)
 	for {
-		newPath := fmt.Sprintf("%s (%d)%s", base, counter, ext)
-		if _, err := os.Stat(newPath); os.IsNotExist(err) {
-			return newPath
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
 		}
-		counter++
+		if err != nil {
+			return err
+		}
+		if header.Name == manifestName {
+			continue
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// walkBundle calls fn with the contents of every entry in a bundle
+func walkBundle(bundle string, fn func(name string, r io.Reader) error) error {
+	if strings.HasSuffix(bundle, ".zip") || isZipFile(bundle) {
+		r, err := zip.OpenReader(bundle)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		for _, f := range r.File {
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			err = fn(f.Name, rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	f, err := os.Open(bundle)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+
+	tr := tar.NewReader(gr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(header.Name, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// isZipFile checks the magic bytes, since temporary bundles have no extension
+func isZipFile(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return false
+	}
+	return bytes.Equal(magic, []byte("PK\x03\x04"))
+}
+
+func readManifest(bundle string) (*ArchiveManifest, error) {
+	var manifest *ArchiveManifest
+	err := walkBundle(bundle, func(name string, r io.Reader) error {
+		if name != manifestName {
+			return nil
+		}
+		manifest = &ArchiveManifest{}
+		return json.NewDecoder(r).Decode(manifest)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if manifest == nil {
+		return nil, fmt.Errorf("bundle has no %s", manifestName)
+	}
+	return manifest, nil
+}
+
+// verifyBundle reads every entry back, checking the newly added files
+// against the hashes computed while writing them
+func verifyBundle(bundle string, added []bundleEntry, wantFiles int) error {
+	want := make(map[string]string, len(added))
+	for _, e := range added {
+		want[e.name] = e.hash
+	}
+
+	count := 0
+	manifestFound := false
+	err := walkBundle(bundle, func(name string, r io.Reader) error {
+		if name == manifestName {
+			manifestFound = true
+			_, err := io.Copy(io.Discard, r)
+			return err
+		}
+
+		count++
+		h := sha256.New()
+		if _, err := io.Copy(h, r); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if expected, ok := want[name]; ok {
+			if hex.EncodeToString(h.Sum(nil)) != expected {
+				return fmt.Errorf("%s: content mismatch", name)
+			}
+			delete(want, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case !manifestFound:
+		return fmt.Errorf("manifest missing")
+	case len(want) > 0:
+		return fmt.Errorf("%d files missing", len(want))
+	case count != wantFiles:
+		return fmt.Errorf("expected %d files, found %d", wantFiles, count)
+	}
+	return nil
+}
+
+// noteVacated records that a file was moved out of its directory, making the
+// directory a candidate for -prune-empty.
+func (o *Organizer) noteVacated(path string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.vacated == nil {
+		o.vacated = make(map[string]int)
+	}
+	o.vacated[filepath.Dir(path)]++
+}
+
+// pruneEmptyDirs removes vacated directories that are now empty, working up
+// towards (but never removing) the top-level directory.
+func (o *Organizer) pruneEmptyDirs() {
+	root := filepath.Clean(o.Directory)
+	candidates := make(map[string]bool)
+	for dir := range o.vacated {
+		candidates[filepath.Clean(dir)] = true
+	}
+
+	for len(candidates) > 0 {
+		// Deepest directories first, so parents see their children removed
+		var dirs []string
+		for dir := range candidates {
+			dirs = append(dirs, dir)
+		}
+		sort.Slice(dirs, func(i, j int) bool {
+			return strings.Count(dirs[i], string(filepath.Separator)) > strings.Count(dirs[j], string(filepath.Separator))
+		})
+		dir := dirs[0]
+		delete(candidates, dir)
+
+		if dir == root || !strings.HasPrefix(dir, root+string(filepath.Separator)) {
+			continue
+		}
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		remaining := len(entries)
+		if o.DryRun {
+			// Nothing has actually moved, so discount what would have
+			remaining -= o.vacated[dir]
+		}
+		if remaining > 0 {
+			continue
+		}
+
+		relPath, _ := filepath.Rel(o.Directory, dir)
+		if o.DryRun {
+			fmt.Printf("Would remove empty directory: %s\n", relPath)
+		} else {
+			if err := os.Remove(dir); err != nil {
+				log.Printf("Failed to remove %s: %v", dir, err)
+				continue
+			}
+			if o.Verbose {
+				fmt.Printf("Removed empty directory: %s\n", relPath)
+			}
+		}
+
+		o.Pruned = append(o.Pruned, relPath)
+		parent := filepath.Dir(dir)
+		o.vacated[parent]++
+		candidates[parent] = true
 	}
 }
 
@@ -361,6 +3237,17 @@ func (o *Organizer) PrintSummary() {
 	fmt.Println("Organization Summary")
 	fmt.Println(strings.Repeat("=", 50))
 
+	o.printConflicts()
+	o.printRefused()
+
+	if len(o.Pruned) > 0 {
+		fmt.Printf("Removed empty directories: %d\n\n", len(o.Pruned))
+	}
+
+	if o.failed > 0 {
+		fmt.Printf("Failed operations: %d (use -report for details)\n\n", o.failed)
+	}
+
 	if len(o.Stats) == 0 {
 		fmt.Println("No files were organized.")
 		return
@@ -383,7 +3270,33 @@ func (o *Organizer) PrintSummary() {
 	fmt.Printf("\nTotal files organized: %d\n", total)
 
 	if o.DryRun {
-		fmt.Println("\nThis was a dry run. No files were actually moved.")
+		fmt.Println("\nThis was a dry run. No files were actually changed.")
 		fmt.Println("Run without --dry-run to organize the files.")
 	}
 }
+
+func (o *Organizer) printConflicts() {
+	if len(o.Conflicts) == 0 {
+		return
+	}
+
+	fmt.Printf("Conflicts (%d):\n", len(o.Conflicts))
+	for _, c := range o.Conflicts {
+		relPath, _ := filepath.Rel(o.Directory, c.Source)
+		targetRelPath, _ := filepath.Rel(o.Directory, c.Target)
+		fmt.Printf("  %s -> %s: %s\n", relPath, targetRelPath, c.Action)
+	}
+	fmt.Println()
+}
+
+func (o *Organizer) printRefused() {
+	if len(o.Refused) == 0 {
+		return
+	}
+
+	fmt.Printf("Refused operations (%d):\n", len(o.Refused))
+	for _, r := range o.Refused {
+		fmt.Printf("  %s\n", r)
+	}
+	fmt.Println()
+}
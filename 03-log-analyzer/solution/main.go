@@ -2,16 +2,33 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"container/heap"
+	"context"
 	"encoding/csv"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"hash/fnv"
+	"html/template"
+	"io"
 	"log"
+	"math"
+	"math/bits"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"regexp"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -23,8 +40,127 @@ type LogEntry struct {
 	Protocol  string
 	Status    int
 	Size      int64
+	Duration  time.Duration
+	Timed     bool
 	UserAgent string
 	Referer   string
+	Host      string
+	Program   string
+	Message   string
+	Country   string `json:",omitempty"`
+	ASN       string `json:",omitempty"`
+	Org       string `json:",omitempty"`
+	Label     string `json:",omitempty"`
+	Fields    map[string]string
+	Source    string
+}
+
+// Field returns a built-in field by name, or an extra field captured by a
+// named group or JSON mapping
+func (e *LogEntry) Field(name string) (string, bool) {
+	switch name {
+	case "ip":
+		return e.IP, true
+	case "time":
+		return e.Timestamp.Format(time.RFC3339), true
+	case "method":
+		return e.Method, true
+	case "url":
+		return e.URL, true
+	case "path":
+		return stripQuery(e.URL), true
+	case "protocol":
+		return e.Protocol, true
+	case "status":
+		return strconv.Itoa(e.Status), true
+	case "status_class":
+		return statusClass(e.Status), e.Status != 0
+	case "size":
+		return strconv.FormatInt(e.Size, 10), true
+	case "duration":
+		return strconv.FormatFloat(float64(e.Duration)/float64(time.Millisecond), 'f', -1, 64), e.Timed
+	case "user_agent":
+		return e.UserAgent, true
+	case "referer":
+		return e.Referer, true
+	case "host":
+		return e.Host, true
+	case "program":
+		return e.Program, true
+	case "message":
+		return e.Message, true
+	case "file":
+		return e.Source, true
+	}
+
+	// Enrichment from -ipdb, falling back to a logged field of the same name
+	var enriched string
+	switch name {
+	case "country":
+		enriched = e.Country
+	case "asn":
+		enriched = e.ASN
+	case "org":
+		enriched = e.Org
+	case "label":
+		enriched = e.Label
+	}
+	if enriched != "" {
+		return enriched, true
+	}
+	value, ok := e.Fields[name]
+	return value, ok
+}
+
+// Fields every entry has, as named by Field
+var filterFields = []string{
+	"ip", "time", "method", "url", "path", "protocol", "status", "status_class",
+	"size", "duration", "user_agent", "referer", "host", "program", "message",
+	"file", "country", "asn", "org", "label",
+}
+
+// extraFields lists the names a parser keeps in LogEntry.Fields: custom
+// pattern groups and JSON mappings that are not built-in fields
+func extraFields(parser Parser) []string {
+	var names []string
+	switch p := parser.(type) {
+	case *RegexParser:
+		for _, name := range p.pattern.SubexpNames() {
+			if _, builtin := namedGroupAliases[name]; name != "" && !builtin {
+				names = append(names, name)
+			}
+		}
+	case *JSONParser:
+		for field := range p.Fields {
+			if _, builtin := jsonFieldCandidates[field]; !builtin {
+				names = append(names, field)
+			}
+		}
+	}
+	return names
+}
+
+// stripQuery drops the query string from a URL
+func stripQuery(url string) string {
+	if idx := strings.Index(url, "?"); idx > 0 {
+		return url[:idx]
+	}
+	return url
+}
+
+// Parser turns a single log line into a LogEntry
+type Parser interface {
+	Name() string
+	Parse(line string) (*LogEntry, error)
+}
+
+// ParserConfig collects the flags that select and configure a Parser
+type ParserConfig struct {
+	Format      string
+	Pattern     string
+	TimeLayout  string
+	NginxFormat string
+	JSONFields  string
 }
 
 type Stats struct {
@@ -34,8 +170,28 @@ type Stats struct {
 	TopIPs          map[string]int
 	TopPages        map[string]int
 	TopUserAgents   map[string]int
+	TopCountries    map[string]int `json:",omitempty"`
+	TopNetworks     map[string]int `json:",omitempty"`
+	TopLabels       map[string]int `json:",omitempty"`
 	RequestsPerHour map[string]int
 	RequestsPerDay  map[string]int
+	ErrorsPerHour   map[string]int
+	ErrorsPerDay    map[string]int
+	BytesPerHour    map[string]int64
+	BytesPerDay     map[string]int64
+	IPsPerHour      map[string]map[string]int `json:"-"`
+	RequestsPerFile map[string]int
+	Latency         *LatencySketch
+	LatencyByPage   map[string]*LatencySketch
+	LatencyByStatus map[string]*LatencySketch
+	Groups          *GroupReport `json:",omitempty"`
+	UniqueIPs       int
+	UniquePages     int
+	Approx          *ApproxStats `json:",omitempty"`
+	TotalErrors     int
+	Anomalies       []Anomaly
+	Alerts          *AlertTracker `json:"-"`
+	Violations      []Violation   `json:",omitempty"`
 	ErrorEntries    []LogEntry
 	InvalidLines    int
 	ParseErrors     int
@@ -47,29 +203,92 @@ const (
 	TextFormat OutputFormat = "text"
 	JSONFormat OutputFormat = "json"
 	CSVFormat  OutputFormat = "csv"
+	HTMLFormat OutputFormat = "html"
 )
 
+// Number of lines inspected when detecting the log format
+const detectLines = 20
+
+// Apache/nginx timestamp layout used by the common and combined formats
+const clfTimeLayout = "02/Jan/2006:15:04:05 -0700"
+
+// Default nginx log_format, identical to the built-in "combined" format
+const nginxCombinedFormat = `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent"`
+
+// Common Log Format + Extended Log Format, optionally followed by the
+// response time as Apache %D (microseconds) or nginx $request_time (seconds)
+var combinedPattern = regexp.MustCompile(`^(\S+) \S+ \S+ \[([\w:/]+\s[+\-]\d{4})\] "(\S+) (\S+) (\S+)" (\d{3}) (\d+|-)(?: "([^"]*)" "([^"]*)"(?: (\d+(?:\.\d+)?))?)?`)
+
 func main() {
 	var (
-		file    = flag.String("f", "", "Log file to analyze (required)")
-		pattern = flag.String("p", "", "Custom regex pattern for parsing")
-		start   = flag.String("s", "", "Start time (RFC3339 format)")
-		end     = flag.String("e", "", "End time (RFC3339 format)")
-		output  = flag.String("o", "text", "Output format (text, json, csv)")
-		top     = flag.Int("t", 10, "Number of top results to show")
-		verbose = flag.Bool("v", false, "Verbose output")
-		help    = flag.Bool("h", false, "Show help")
+		file     = flag.String("f", "", "Comma-separated log files or globs to analyze, - for stdin (required)")
+		pattern  = flag.String("p", "", "Custom regex pattern with named groups, e.g. (?P<ip>\\S+) ... (?P<status>\\d{3})")
+		layout   = flag.String("time-layout", clfTimeLayout, "Go time layout for the (?P<time>...) group of -p")
+		logFmt   = flag.String("format", "auto", "Log format (auto, combined, common, nginx, json, syslog)")
+		nginx    = flag.String("log-format", nginxCombinedFormat, "nginx log_format string used by -format nginx")
+		fields   = flag.String("json-fields", "", "JSON field mapping, e.g. ip=client.ip,time=@timestamp,status=code")
+		start    = flag.String("s", "", "Start time (RFC3339 format)")
+		end      = flag.String("e", "", "End time (RFC3339 format)")
+		groupBy  = flag.String("group-by", "", "Comma-separated fields to group by, e.g. status,method")
+		bucket   = flag.Duration("bucket", 0, "Group into time buckets of this width, e.g. 5m")
+		where    = flag.String("where", "", "Filter expression, e.g. 'status >= 500 && url ~ \"^/api/\" && !(ip in 10.0.0.0/8)'")
+		output   = flag.String("o", "text", "Output format (text, json, csv, html)")
+		csvDir   = flag.String("csv-dir", "", "With -o csv, write one file per section into this directory")
+		top      = flag.Int("t", 10, "Number of top results to show")
+		follow   = flag.Bool("follow", false, "Tail the log and show a live dashboard until interrupted")
+		window   = flag.Duration("window", 5*time.Minute, "Rolling window for -follow statistics")
+		refresh  = flag.Duration("refresh", 2*time.Second, "Dashboard refresh interval for -follow")
+		listen   = flag.String("listen", ":9180", "Address for the serve subcommand's HTTP server")
+		approx   = flag.Bool("approx", false, "Bounded-memory mode: approximate top lists and unique counts (always on for serve)")
+		counters = flag.Int("approx-counters", 1000, "Counters per top list in -approx mode")
+		maxErrs  = flag.Int("max-errors", 0, "Keep at most this many error entries (0 = all, 1000 with -approx or serve)")
+		split    = flag.String("split", "", "With compare, split one input at this time (RFC3339) into before and after")
+		rules    = flag.String("rules", "", "JSON file of threshold alert rules; exits with status 3 when any is violated")
+		ipdb     = flag.String("ipdb", "", "IP databases for country/ASN/label enrichment: .mmdb files or CSVs of network,country,asn,org,label (comma-separated, earlier wins)")
+		workers  = flag.Int("workers", runtime.NumCPU(), "Number of parallel workers for large files (1 reads sequentially, as do -approx and -max-errors)")
+		verbose  = flag.Bool("v", false, "Verbose output")
+		help     = flag.Bool("h", false, "Show help")
 	)
 
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "Analyze web server log files and generate statistics.\n\n")
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] [file ...]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [options] serve [file]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [options] compare before after\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [options] -split time compare [file ...]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Analyze web server log files and generate statistics.\n")
+		fmt.Fprintf(os.Stderr, "serve follows one log in bounded memory (-approx) and exposes /metrics (Prometheus) and /stats (JSON).\n")
+		fmt.Fprintf(os.Stderr, "compare reports the changes between two inputs, or before and after -split.\n")
+		fmt.Fprintf(os.Stderr, "Gzip and bzip2 files are decompressed automatically.\n")
+		fmt.Fprintf(os.Stderr, "-approx estimates the top lists, unique counts and per-page latency; every other figure stays exact.\n\n")
 		fmt.Fprintf(os.Stderr, "Options:\n")
 		flag.PrintDefaults()
 		fmt.Fprintf(os.Stderr, "\nExamples:\n")
 		fmt.Fprintf(os.Stderr, "  %s -f access.log\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s -f access.log -t 20 -o json\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -f access.log -o html > report.html\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -f access.log -o csv -csv-dir report/\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -f 'access.log*'\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  zcat old.log.gz | %s -f -\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -f access.log -follow -window 1m\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -listen :9180 serve access.log\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -f access.log -rules alerts.json || page-oncall\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s compare 'monday.log*' 'tuesday.log*'\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -split 2023-10-10T14:00:00Z compare access.log\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -f access.log -ipdb labels.csv,GeoLite2-Country.mmdb,GeoLite2-ASN.mmdb -group-by country\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -f access.log -where 'status >= 500 && duration > 250ms'\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -f access.log -where 'status >= 500' -group-by path -bucket 10m\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nFilter and group-by fields: ip, time, method, url, path, protocol, status, status_class,\n")
+		fmt.Fprintf(os.Stderr, "size, duration (ms), ")
+		fmt.Fprintf(os.Stderr, "user_agent, referer, host, program, message, file, country, asn, org, label (with -ipdb),\n")
+		fmt.Fprintf(os.Stderr, "and named groups from -p.\n")
+		fmt.Fprintf(os.Stderr, "Operators: == != < <= > >= ~ !~ (regex) in (CIDR or list), && || ! and parentheses.\n")
 		fmt.Fprintf(os.Stderr, "  %s -f access.log -s 2023-10-01T00:00:00Z -e 2023-10-02T00:00:00Z\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -f app.jsonl -format json -json-fields ip=client,time=ts\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -f access.log -format nginx -log-format '$remote_addr [$time_local] \"$request\" $status'\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nRules file (-rules): {\"rules\": [{\"name\": ..., \"metric\": ..., \"op\": \">\", \"threshold\": 2,\n")
+		fmt.Fprintf(os.Stderr, "  \"per\": \"1h\", \"where\": \"path == /checkout\", \"min_requests\": 20}]}\n")
+		fmt.Fprintf(os.Stderr, "Metrics: %s;\n", strings.Join(windowedMetrics, ", "))
+		fmt.Fprintf(os.Stderr, "for the whole run only: %s.\n", strings.Join(runMetrics, ", "))
 	}
 
 	flag.Parse()
@@ -79,15 +298,56 @@ func main() {
 		return
 	}
 
-	if *file == "" {
+	args := flag.Args()
+	serve := len(args) > 0 && args[0] == "serve"
+	compare := len(args) > 0 && args[0] == "compare"
+	if serve || compare {
+		args = args[1:]
+	}
+
+	// compare takes two inputs, each a comma-separated list, unless one
+	// input is split in time
+	if *split != "" && !compare {
+		log.Fatalf("-split requires compare")
+	}
+	var sides [][]string
+	if compare && (*rules != "" || *groupBy != "" || *bucket != 0) {
+		fmt.Fprintf(os.Stderr, "Error: compare cannot be combined with -rules, -group-by or -bucket\n\n")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if compare && *split == "" {
+		if *file != "" || len(args) != 2 {
+			fmt.Fprintf(os.Stderr, "Error: compare requires exactly two inputs, or one with -split\n\n")
+			flag.Usage()
+			os.Exit(1)
+		}
+		sides = [][]string{strings.Split(args[0], ","), strings.Split(args[1], ",")}
+		args = nil
+	}
+
+	var inputs []string
+	if *file != "" {
+		inputs = strings.Split(*file, ",")
+	}
+	inputs = append(inputs, args...)
+	if len(inputs) == 0 && sides == nil {
 		fmt.Fprintf(os.Stderr, "Error: Log file is required\n\n")
 		flag.Usage()
 		os.Exit(1)
 	}
 
+	var files []string
+	var err error
+	if sides == nil {
+		files, err = expandInputs(inputs)
+		if err != nil {
+			log.Fatalf("Invalid input: %v", err)
+		}
+	}
+
 	// Parse time filters
 	var startTime, endTime time.Time
-	var err error
 
 	if *start != "" {
 		startTime, err = time.Parse(time.RFC3339, *start)
@@ -103,52 +363,184 @@ func main() {
 		}
 	}
 
+	var splitTime time.Time
+	if *split != "" {
+		splitTime, err = time.Parse(time.RFC3339, *split)
+		if err != nil {
+			log.Fatalf("Invalid split time format: %v", err)
+		}
+	}
+
+	// Select the log parser; auto detection happens once the file is open
+	parser, err := newParser(ParserConfig{
+		Format:      *logFmt,
+		Pattern:     *pattern,
+		TimeLayout:  *layout,
+		NginxFormat: *nginx,
+		JSONFields:  *fields,
+	})
+	if err != nil {
+		log.Fatalf("Invalid log format: %v", err)
+	}
+
+	// Parse the entry filter once
+	var filter Filter
+	if *where != "" {
+		filter, err = ParseFilter(*where, extraFields(parser))
+		if err != nil {
+			log.Fatalf("Invalid -where expression: %v", err)
+		}
+	}
+
+	if *counters < 1 || *maxErrs < 0 {
+		log.Fatalf("Invalid -approx-counters or -max-errors: %d, %d", *counters, *maxErrs)
+	}
+	maxErrors := *maxErrs
+	if (*approx || serve) && maxErrors == 0 {
+		maxErrors = 1000
+	}
+
+	if *workers < 1 {
+		log.Fatalf("Invalid -workers: %d (must be at least 1)", *workers)
+	}
+
+	// Parse the grouping
+	var groups *GroupBy
+	if *bucket < 0 {
+		log.Fatalf("Invalid -bucket: %v (must be positive)", *bucket)
+	}
+	if *groupBy != "" || *bucket > 0 {
+		groups = &GroupBy{Bucket: *bucket}
+		if *groupBy != "" {
+			for _, field := range strings.Split(*groupBy, ",") {
+				if field = strings.TrimSpace(field); field != "" {
+					groups.Fields = append(groups.Fields, field)
+				}
+			}
+		}
+	}
+
 	// Parse output format
 	format := OutputFormat(*output)
 	switch format {
-	case TextFormat, JSONFormat, CSVFormat:
+	case TextFormat, JSONFormat, CSVFormat, HTMLFormat:
 		// Valid format
 	default:
-		log.Fatalf("Invalid output format: %s (use text, json, or csv)", *output)
+		log.Fatalf("Invalid output format: %s (use text, json, csv, or html)", *output)
+	}
+	if *csvDir != "" && format != CSVFormat {
+		log.Fatalf("-csv-dir requires -o csv")
+	}
+
+	// Load the alert rules
+	var alertRules []*AlertRule
+	if *rules != "" {
+		alertRules, err = LoadAlertRules(*rules, extraFields(parser))
+		if err != nil {
+			log.Fatalf("Invalid -rules: %v", err)
+		}
+	}
+
+	// Load the IP databases
+	var enricher *Enricher
+	if *ipdb != "" {
+		enricher, err = OpenEnricher(strings.Split(*ipdb, ","))
+		if err != nil {
+			log.Fatalf("Invalid -ipdb: %v", err)
+		}
 	}
 
 	// Analyze log file
 	analyzer := &LogAnalyzer{
-		FilePath:      *file,
+		Files:         files,
 		CustomPattern: *pattern,
+		Parser:        parser,
 		StartTime:     startTime,
 		EndTime:       endTime,
+		Where:         filter,
+		GroupBy:       groups,
 		TopCount:      *top,
+		Workers:       *workers,
+		Approx:        *approx || serve,
+		Counters:      *counters,
+		MaxErrors:     maxErrors,
+		Enricher:      enricher,
+		Rules:         alertRules,
 		Verbose:       *verbose,
 	}
 
-	stats, err := analyzer.Analyze()
+	if serve {
+		if len(files) != 1 {
+			log.Fatalf("serve needs exactly one log file (got %d)", len(files))
+		}
+		if err := analyzer.Serve(*listen); err != nil {
+			log.Fatalf("Server failed: %v", err)
+		}
+		return
+	}
+
+	if compare {
+		if *follow {
+			log.Fatalf("-follow cannot be combined with compare")
+		}
+		if format == HTMLFormat {
+			log.Fatalf("Invalid output format for compare: %s (use text, json, or csv)", format)
+		}
+		comparison, err := analyzer.Compare(sides, splitTime)
+		if err != nil {
+			log.Fatalf("Comparison failed: %v", err)
+		}
+		if err := outputComparison(comparison, format, *csvDir); err != nil {
+			log.Fatalf("Failed to output results: %v", err)
+		}
+		return
+	}
+
+	var stats *Stats
+	if *follow {
+		if len(files) != 1 {
+			log.Fatalf("-follow needs exactly one log file (got %d)", len(files))
+		}
+		if *window <= 0 || *refresh <= 0 {
+			log.Fatalf("Invalid -window or -refresh: both must be positive")
+		}
+		stats, err = analyzer.Follow(*window, *refresh)
+	} else {
+		stats, err = analyzer.Analyze()
+	}
 	if err != nil {
 		log.Fatalf("Analysis failed: %v", err)
 	}
 
 	// Output results
-	if err := outputResults(stats, format, *top); err != nil {
+	if err := outputResults(stats, format, *top, *csvDir); err != nil {
 		log.Fatalf("Failed to output results: %v", err)
 	}
+
+	if len(stats.Violations) > 0 {
+		os.Exit(alertExitCode)
+	}
 }
 
 type LogAnalyzer struct {
-	FilePath      string
+	Files         []string
 	CustomPattern string
+	Parser        Parser
 	StartTime     time.Time
 	EndTime       time.Time
+	Where         Filter
+	GroupBy       *GroupBy
 	TopCount      int
+	Workers       int
+	Approx        bool
+	Counters      int
+	MaxErrors     int
+	Enricher      *Enricher
+	Rules         []*AlertRule
 	Verbose       bool
 }
 
-func (la *LogAnalyzer) Analyze() (*Stats, error) {
-	file, err := os.Open(la.FilePath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open log file: %w", err)
-	}
-	defer file.Close()
-
+func (la *LogAnalyzer) newStats() *Stats {
 	stats := &Stats{
 		StatusCodes:     make(map[int]int),
 		TopIPs:          make(map[string]int),
@@ -156,172 +548,4730 @@ func (la *LogAnalyzer) Analyze() (*Stats, error) {
 		TopUserAgents:   make(map[string]int),
 		RequestsPerHour: make(map[string]int),
 		RequestsPerDay:  make(map[string]int),
+		ErrorsPerHour:   make(map[string]int),
+		ErrorsPerDay:    make(map[string]int),
+		BytesPerHour:    make(map[string]int64),
+		BytesPerDay:     make(map[string]int64),
+		IPsPerHour:      make(map[string]map[string]int),
+		RequestsPerFile: make(map[string]int),
+		LatencyByPage:   make(map[string]*LatencySketch),
+		LatencyByStatus: make(map[string]*LatencySketch),
+	}
+	if la.GroupBy != nil {
+		stats.Groups = NewGroupReport(*la.GroupBy)
+	}
+	if la.Approx {
+		stats.Approx = NewApproxStats(la.Counters)
+	}
+	if la.Rules != nil {
+		stats.Alerts = NewAlertTracker(la.Rules)
+	}
+	if la.Enricher != nil {
+		stats.TopCountries = make(map[string]int)
+		stats.TopNetworks = make(map[string]int)
+		stats.TopLabels = make(map[string]int)
+	}
+	return stats
+}
+
+// Analyze reads every input and returns the combined statistics. With
+// more than one worker, plain files are split into chunks parsed in
+// parallel; the result is identical to reading sequentially. Space-Saving
+// summaries and the kept error entries depend on the order entries arrive
+// in, so -approx and -max-errors runs always read sequentially.
+func (la *LogAnalyzer) Analyze() (*Stats, error) {
+	if la.Verbose && la.CustomPattern != "" {
+		fmt.Printf("Using custom regex pattern: %s\n", la.CustomPattern)
+	}
+
+	var stats *Stats
+	var lines int
+	var err error
+	if la.Workers > 1 && !la.Approx && la.MaxErrors == 0 {
+		stats, lines, err = la.analyzeParallel()
+	} else {
+		stats, lines, err = la.analyzeSequential()
+	}
+	if err != nil {
+		return nil, err
+	}
+	la.sortErrorEntries(stats)
+	la.finalize(stats)
+
+	if la.Verbose {
+		fmt.Printf("Processed %d lines, %d valid entries, %d errors\n",
+			lines, stats.TotalRequests, stats.ParseErrors)
+	}
+
+	return stats, nil
+}
+
+// analyzeSequential merges all inputs by timestamp on one goroutine
+func (la *LogAnalyzer) analyzeSequential() (*Stats, int, error) {
+	stats := la.newStats()
+
+	// Open every input up front so entries can be merged by timestamp
+	sources := &sourceHeap{}
+	defer func() {
+		for _, src := range *sources {
+			src.Close()
+		}
+	}()
+	lines := 0
+	for i, path := range la.Files {
+		src, err := la.openSource(path)
+		if err != nil {
+			return nil, 0, err
+		}
+		src.order = i
+		ok, err := src.next(la, stats)
+		if err != nil {
+			src.Close()
+			return nil, 0, err
+		}
+		if !ok {
+			lines += src.lineNum
+			src.Close()
+			continue
+		}
+		*sources = append(*sources, src)
+	}
+	heap.Init(sources)
+
+	// Rotated and concurrent files interleave in chronological order
+	for sources.Len() > 0 {
+		src := (*sources)[0]
+		la.processEntry(src.entry, stats)
+
+		ok, err := src.next(la, stats)
+		if err != nil {
+			return nil, 0, err
+		}
+		if ok {
+			heap.Fix(sources, 0)
+		} else {
+			lines += src.lineNum
+			src.Close()
+			heap.Pop(sources)
+		}
+	}
+
+	return stats, lines, nil
+}
+
+// Plain files smaller than this are parsed as a single chunk
+const minChunkSize = 4 << 20
+
+// chunkJob is a newline-aligned byte range of a file, or a whole stream
+// for stdin and compressed inputs that cannot be split
+type chunkJob struct {
+	path   string
+	parser Parser
+	start  int64
+	end    int64
+	whole  bool
+}
+
+type chunkResult struct {
+	stats *Stats
+	lines int
+	err   error
+}
+
+// analyzeParallel parses chunks on la.Workers goroutines, each building
+// partial stats, and merges them in input order
+func (la *LogAnalyzer) analyzeParallel() (*Stats, int, error) {
+	var jobs []chunkJob
+	for _, path := range la.Files {
+		fileJobs, err := la.planChunks(path)
+		if err != nil {
+			return nil, 0, err
+		}
+		jobs = append(jobs, fileJobs...)
+	}
+
+	results := make([]chunkResult, len(jobs))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < la.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i].stats, results[i].lines, results[i].err = la.analyzeChunk(jobs[i])
+			}
+		}()
+	}
+	for i := range jobs {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	stats := la.newStats()
+	lines := 0
+	for _, result := range results {
+		if result.err != nil {
+			return nil, 0, result.err
+		}
+		stats.Merge(result.stats)
+		lines += result.lines
+	}
+	return stats, lines, nil
+}
+
+// planChunks splits a plain file into newline-aligned ranges, one per
+// worker or more for balance. Stdin and compressed files become one job.
+func (la *LogAnalyzer) planChunks(path string) ([]chunkJob, error) {
+	if path == "-" {
+		return []chunkJob{{path: path, whole: true}}, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	magic := make([]byte, 3)
+	n, _ := file.ReadAt(magic, 0)
+	if !info.Mode().IsRegular() || isCompressed(magic[:n]) {
+		return []chunkJob{{path: path, whole: true}}, nil
 	}
 
-	// Use custom pattern if provided, otherwise default to common log format
-	var logPattern *regexp.Regexp
-	if la.CustomPattern != "" {
-		logPattern = regexp.MustCompile(la.CustomPattern)
+	parser := la.Parser
+	if parser == nil {
+		head, err := readHead(path, detectLines)
+		if err != nil {
+			return nil, err
+		}
+		parser = detectParser(head)
 		if la.Verbose {
-			fmt.Printf("Using custom regex pattern: %s\n", la.CustomPattern)
+			fmt.Printf("Detected log format for %s: %s\n", path, parser.Name())
 		}
-	} else {
-		// Common Log Format + Extended Log Format
-		logPattern = regexp.MustCompile(`^(\S+) \S+ \S+ \[([\w:/]+\s[+\-]\d{4})\] "(\S+) (\S+) (\S+)" (\d{3}) (\d+|-)(?: "([^"]*)" "([^"]*)")?`)
 	}
 
-	scanner := bufio.NewScanner(file)
-	lineNum := 0
+	size := info.Size()
+	parts := int(size / minChunkSize)
+	if limit := la.Workers * 4; parts > limit {
+		parts = limit
+	}
+	if parts < 1 {
+		parts = 1
+	}
+
+	var jobs []chunkJob
+	start := int64(0)
+	for i := 1; i <= parts && start < size; i++ {
+		end := size
+		if i < parts {
+			end, err = nextLineStart(file, size*int64(i)/int64(parts), size)
+			if err != nil {
+				return nil, fmt.Errorf("failed to split %s: %w", path, err)
+			}
+			// A line longer than a chunk swallows the following boundary
+			if end <= start {
+				continue
+			}
+		}
+		jobs = append(jobs, chunkJob{path: path, parser: parser, start: start, end: end})
+		start = end
+	}
+	return jobs, nil
+}
+
+// nextLineStart returns the offset just past the first newline at or after
+// offset, or size when there is none
+func nextLineStart(file *os.File, offset, size int64) (int64, error) {
+	buf := make([]byte, 64*1024)
+	for offset < size {
+		n, err := file.ReadAt(buf, offset)
+		if i := bytes.IndexByte(buf[:n], '\n'); i >= 0 {
+			return offset + int64(i) + 1, nil
+		}
+		offset += int64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return size, nil
+}
+
+func isCompressed(magic []byte) bool {
+	return (len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b) ||
+		(len(magic) == 3 && string(magic) == "BZh")
+}
 
-	for scanner.Scan() {
-		lineNum++
-		line := strings.TrimSpace(scanner.Text())
+// analyzeChunk parses one job into its own partial stats
+func (la *LogAnalyzer) analyzeChunk(job chunkJob) (*Stats, int, error) {
+	stats := la.newStats()
 
-		// Skip empty lines and comments
+	if job.whole {
+		src, err := la.openSource(job.path)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer src.Close()
+		for {
+			ok, err := src.next(la, stats)
+			if err != nil {
+				return nil, 0, err
+			}
+			if !ok {
+				return stats, src.lineNum, nil
+			}
+			la.processEntry(src.entry, stats)
+		}
+	}
+
+	file, err := os.Open(job.path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open log file: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReaderSize(io.NewSectionReader(file, job.start, job.end-job.start), 256*1024)
+	offset := job.start
+	lines := 0
+	for {
+		raw, err := readLine(reader)
+		if err == io.EOF {
+			return stats, lines, nil
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("error reading %s: %w", job.path, err)
+		}
+		lineStart := offset
+		offset += int64(len(raw)) + 1
+		lines++
+
+		line := strings.TrimSpace(raw)
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
 
-		entry, err := la.parseLogLine(line, logPattern, lineNum)
+		entry, err := job.parser.Parse(line)
 		if err != nil {
 			if la.Verbose {
-				log.Printf("Line %d: %v", lineNum, err)
+				log.Printf("%s (byte %d): %v", job.path, lineStart, err)
 			}
 			stats.ParseErrors++
 			continue
 		}
+		entry.Source = job.path
+		la.enrich(entry)
+		la.processEntry(entry, stats)
+	}
+}
+
+// readLine reads a whole line of any length without its line ending. A
+// final line without a newline is returned before io.EOF.
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+// sortErrorEntries orders error entries by time, then by input, keeping
+// line order otherwise, so sequential and parallel runs agree
+func (la *LogAnalyzer) sortErrorEntries(stats *Stats) {
+	order := make(map[string]int)
+	for i, path := range la.Files {
+		if path == "-" {
+			path = "stdin"
+		}
+		order[path] = i
+	}
+	sort.SliceStable(stats.ErrorEntries, func(i, j int) bool {
+		a, b := &stats.ErrorEntries[i], &stats.ErrorEntries[j]
+		if !a.Timestamp.Equal(b.Timestamp) {
+			return a.Timestamp.Before(b.Timestamp)
+		}
+		return order[a.Source] < order[b.Source]
+	})
+}
+
+// Merge adds the counts of a partial result into s
+func (s *Stats) Merge(other *Stats) {
+	s.TotalRequests += other.TotalRequests
+	s.TotalBytes += other.TotalBytes
+	s.InvalidLines += other.InvalidLines
+	s.ParseErrors += other.ParseErrors
+	s.TotalErrors += other.TotalErrors
+	if s.Approx != nil && other.Approx != nil {
+		s.Approx.Merge(other.Approx)
+	}
+	for k, v := range other.StatusCodes {
+		s.StatusCodes[k] += v
+	}
+	for _, pair := range []struct{ dst, src map[string]int }{
+		{s.TopIPs, other.TopIPs},
+		{s.TopPages, other.TopPages},
+		{s.TopUserAgents, other.TopUserAgents},
+		{s.TopCountries, other.TopCountries},
+		{s.TopNetworks, other.TopNetworks},
+		{s.TopLabels, other.TopLabels},
+		{s.RequestsPerHour, other.RequestsPerHour},
+		{s.RequestsPerDay, other.RequestsPerDay},
+		{s.RequestsPerFile, other.RequestsPerFile},
+		{s.ErrorsPerHour, other.ErrorsPerHour},
+		{s.ErrorsPerDay, other.ErrorsPerDay},
+	} {
+		for k, v := range pair.src {
+			pair.dst[k] += v
+		}
+	}
+	for k, v := range other.BytesPerHour {
+		s.BytesPerHour[k] += v
+	}
+	for k, v := range other.BytesPerDay {
+		s.BytesPerDay[k] += v
+	}
+	for hour, ips := range other.IPsPerHour {
+		mine, ok := s.IPsPerHour[hour]
+		if !ok {
+			mine = make(map[string]int, len(ips))
+			s.IPsPerHour[hour] = mine
+		}
+		for ip, n := range ips {
+			mine[ip] += n
+		}
+	}
+
+	if other.Latency != nil {
+		if s.Latency == nil {
+			s.Latency = NewLatencySketch()
+		}
+		s.Latency.Merge(other.Latency)
+	}
+	mergeSketches(s.LatencyByPage, other.LatencyByPage)
+	if s.Approx != nil {
+		for page := range s.LatencyByPage {
+			if !s.Approx.Pages.Tracked(page) {
+				delete(s.LatencyByPage, page)
+			}
+		}
+	}
+	mergeSketches(s.LatencyByStatus, other.LatencyByStatus)
+
+	if s.Groups != nil && other.Groups != nil {
+		s.Groups.Merge(other.Groups)
+	}
+	if s.Alerts != nil && other.Alerts != nil {
+		s.Alerts.Merge(other.Alerts)
+	}
+	s.ErrorEntries = append(s.ErrorEntries, other.ErrorEntries...)
+}
+
+func mergeSketches(dst, src map[string]*LatencySketch) {
+	for key, sketch := range src {
+		if _, ok := dst[key]; !ok {
+			dst[key] = NewLatencySketch()
+		}
+		dst[key].Merge(sketch)
+	}
+}
+
+// processEntry applies the filters and adds an entry to the stats
+func (la *LogAnalyzer) processEntry(entry *LogEntry, stats *Stats) {
+	if !la.accept(entry) {
+		return
+	}
+
+	la.updateStats(entry, stats)
+	stats.TotalRequests++
+	stats.TotalBytes += entry.Size
+
+	// Collect error entries, up to -max-errors
+	if entry.Status >= 400 {
+		stats.TotalErrors++
+		if la.MaxErrors == 0 || len(stats.ErrorEntries) < la.MaxErrors {
+			stats.ErrorEntries = append(stats.ErrorEntries, *entry)
+		}
+	}
+}
+
+// finalize fills the derived fields once all entries are counted: the
+// top lists in approximate mode and the unique counts
+func (la *LogAnalyzer) finalize(stats *Stats) {
+	if la.MaxErrors > 0 && len(stats.ErrorEntries) > la.MaxErrors {
+		stats.ErrorEntries = stats.ErrorEntries[:la.MaxErrors]
+	}
+
+	if a := stats.Approx; a != nil {
+		stats.TopIPs = a.IPs.Counts()
+		stats.TopPages = a.Pages.Counts()
+		stats.TopUserAgents = a.UserAgents.Counts()
+		stats.UniqueIPs = int(a.UniqueIPs.Estimate())
+		stats.UniquePages = int(a.UniquePages.Estimate())
+	} else {
+		stats.UniqueIPs = len(stats.TopIPs)
+		stats.UniquePages = len(stats.TopPages)
+	}
+
+	stats.Anomalies = detectAnomalies(stats)
+	if stats.Alerts != nil {
+		stats.Violations = stats.Alerts.Evaluate(stats)
+	}
+}
+
+// expandInputs resolves globs and validates the input list. "-" stands
+// for stdin and may appear once.
+func expandInputs(inputs []string) ([]string, error) {
+	var files []string
+	seen := make(map[string]bool)
+	for _, input := range inputs {
+		input = strings.TrimSpace(input)
+		if input == "" {
+			continue
+		}
+
+		matches := []string{input}
+		if input != "-" && strings.ContainsAny(input, "*?[") {
+			var err error
+			matches, err = filepath.Glob(input)
+			if err != nil {
+				return nil, fmt.Errorf("bad pattern %q: %w", input, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no files match %q", input)
+			}
+		}
+
+		for _, match := range matches {
+			if !seen[match] {
+				seen[match] = true
+				files = append(files, match)
+			}
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no input files")
+	}
+	return files, nil
+}
+
+// logSource reads parsed entries from one input
+type logSource struct {
+	name    string
+	reader  *bufio.Reader
+	closers []io.Closer
+	parser  Parser
+	pending []string
+	lineNum int
+	order   int
+	entry   *LogEntry
+}
+
+// openSource opens a file (or stdin for "-"), unwraps gzip or bzip2 by
+// magic bytes and detects the log format if none was chosen
+func (la *LogAnalyzer) openSource(path string) (*logSource, error) {
+	src := &logSource{name: path, parser: la.Parser}
+
+	var raw io.Reader = os.Stdin
+	if path == "-" {
+		src.name = "stdin"
+	} else {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open log file: %w", err)
+		}
+		src.closers = append(src.closers, file)
+		raw = file
+	}
+
+	reader, err := decompress(raw)
+	if err != nil {
+		src.Close()
+		return nil, fmt.Errorf("failed to read %s: %w", src.name, err)
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		src.closers = append(src.closers, closer)
+	}
+	src.reader = bufio.NewReader(reader)
+
+	// Buffer the first lines so the format can be detected from them
+	if src.parser == nil {
+		for len(src.pending) < detectLines {
+			line, err := readLine(src.reader)
+			if err != nil {
+				break
+			}
+			src.pending = append(src.pending, line)
+		}
+		src.parser = detectParser(src.pending)
+		if la.Verbose {
+			fmt.Printf("Detected log format for %s: %s\n", src.name, src.parser.Name())
+		}
+	}
+	return src, nil
+}
+
+// decompress returns a reader that transparently inflates gzip or bzip2
+// data, detected by magic bytes rather than file extension
+func decompress(r io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(r)
+	magic, err := buffered.Peek(3)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case !isCompressed(magic):
+		return buffered, nil
+	case magic[0] == 0x1f:
+		return gzip.NewReader(buffered)
+	default:
+		return bzip2.NewReader(buffered), nil
+	}
+}
+
+// next advances to the following parsed entry, counting lines that do
+// not parse. It reports false at end of input.
+func (src *logSource) next(la *LogAnalyzer, stats *Stats) (bool, error) {
+	for {
+		var raw string
+		if len(src.pending) > 0 {
+			raw, src.pending = src.pending[0], src.pending[1:]
+		} else {
+			line, err := readLine(src.reader)
+			if err == io.EOF {
+				return false, nil
+			}
+			if err != nil {
+				return false, fmt.Errorf("error reading %s: %w", src.name, err)
+			}
+			raw = line
+		}
+		src.lineNum++
+		line := strings.TrimSpace(raw)
+
+		// Skip empty lines and comments
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		entry, err := src.parser.Parse(line)
+		if err != nil {
+			if la.Verbose {
+				log.Printf("%s:%d: %v", src.name, src.lineNum, err)
+			}
+			stats.ParseErrors++
+			continue
+		}
+		entry.Source = src.name
+		la.enrich(entry)
+		src.entry = entry
+		return true, nil
+	}
+}
+
+func (src *logSource) Close() {
+	for i := len(src.closers) - 1; i >= 0; i-- {
+		src.closers[i].Close()
+	}
+	src.closers = nil
+}
+
+// sourceHeap orders open sources by the timestamp of their current entry
+type sourceHeap []*logSource
+
+func (h sourceHeap) Len() int { return len(h) }
+func (h sourceHeap) Less(i, j int) bool {
+	ti, tj := h[i].entry.Timestamp, h[j].entry.Timestamp
+	if ti.Equal(tj) {
+		return h[i].order < h[j].order
+	}
+	return ti.Before(tj)
+}
+func (h sourceHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *sourceHeap) Push(x interface{}) { *h = append(*h, x.(*logSource)) }
+func (h *sourceHeap) Pop() interface{} {
+	old := *h
+	src := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return src
+}
+
+// Follow tails the single input, redrawing a dashboard of the rolling
+// window every refresh interval. On interrupt it returns the stats for
+// everything read since it started.
+func (la *LogAnalyzer) Follow(window, refresh time.Duration) (*Stats, error) {
+	stats := la.newStats()
+	lines := make(chan string, 1024)
+	errs := make(chan error, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	name, closeStream, err := la.openStream(la.Files[0], lines, errs, stop)
+	if err != nil {
+		return nil, err
+	}
+	defer closeStream()
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
+
+	ticker := time.NewTicker(refresh)
+	defer ticker.Stop()
+
+	rolling := NewRollingWindow(window)
+	started := time.Now()
+	lineNum := 0
+	la.drawDashboard(name, rolling, stats, started)
+
+	for {
+		select {
+		case raw := <-lines:
+			lineNum++
+			entry := la.parseStreamLine(name, lineNum, raw, stats)
+			if entry == nil {
+				continue
+			}
+			if la.accept(entry) {
+				rolling.Add(time.Now(), entry)
+			}
+			la.processEntry(entry, stats)
+		case <-ticker.C:
+			la.drawDashboard(name, rolling, stats, started)
+		case err := <-errs:
+			return nil, fmt.Errorf("error reading %s: %w", name, err)
+		case <-sigChan:
+			fmt.Println("\n\nShutting down gracefully...")
+			la.finalize(stats)
+			return stats, nil
+		}
+	}
+}
+
+// openStream starts sending new lines of path (or stdin for "-") to lines
+// until stop is closed. It returns the display name and a close function.
+func (la *LogAnalyzer) openStream(path string, lines chan<- string, errs chan<- error, stop <-chan struct{}) (string, func(), error) {
+	if path == "-" {
+		go func() {
+			reader := bufio.NewReader(os.Stdin)
+			for {
+				line, err := readLine(reader)
+				if err == io.EOF {
+					return
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+				select {
+				case lines <- line:
+				case <-stop:
+					return
+				}
+			}
+		}()
+		return "stdin", func() {}, nil
+	}
+
+	tailer, err := OpenTailer(path)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Without -format, detect it from the start of the file
+	if la.Parser == nil {
+		head, err := readHead(path, detectLines)
+		if err != nil {
+			tailer.Close()
+			return "", nil, err
+		}
+		la.Parser = detectParser(head)
+	}
+	go tailer.Run(lines, errs, stop)
+	return path, tailer.Close, nil
+}
+
+// parseStreamLine parses one streamed line, counting parse errors. It
+// returns nil for blank, comment and unparseable lines.
+func (la *LogAnalyzer) parseStreamLine(name string, lineNum int, raw string, stats *Stats) *LogEntry {
+	line := strings.TrimSpace(raw)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+
+	// Stdin has no head to detect from, so use its first line
+	if la.Parser == nil {
+		la.Parser = detectParser([]string{line})
+	}
+
+	entry, err := la.Parser.Parse(line)
+	if err != nil {
+		if la.Verbose {
+			log.Printf("%s:%d: %v", name, lineNum, err)
+		}
+		stats.ParseErrors++
+		return nil
+	}
+	entry.Source = name
+	la.enrich(entry)
+	return entry
+}
+
+// drawDashboard clears the terminal and prints the rolling statistics
+func (la *LogAnalyzer) drawDashboard(name string, rolling *RollingWindow, stats *Stats, started time.Time) {
+	now := time.Now()
+	snap := rolling.Snapshot(now)
+
+	// Before a full window has passed, rates use the time actually covered
+	span := rolling.Size
+	if elapsed := now.Sub(started); elapsed < span {
+		span = elapsed
+	}
+	if span < time.Second {
+		span = time.Second
+	}
+
+	errorRate := 0.0
+	if snap.Requests > 0 {
+		errorRate = float64(snap.Errors) / float64(snap.Requests) * 100
+	}
+
+	fmt.Print("\033[H\033[2J")
+	fmt.Printf("Following %s — last %v (updated %s, Ctrl+C to stop)\n", name, rolling.Size, now.Format("15:04:05"))
+	fmt.Println(strings.Repeat("=", 60))
+	fmt.Printf("  Requests:   %d (%.2f/s)\n", snap.Requests, float64(snap.Requests)/span.Seconds())
+	fmt.Printf("  Errors:     %d (%.1f%%)\n", snap.Errors, errorRate)
+	fmt.Printf("  Bandwidth:  %s (%s/s)\n", formatBytes(snap.Bytes), formatBytes(int64(float64(snap.Bytes)/span.Seconds())))
+	fmt.Printf("  Since start: %d requests, %d parse errors\n\n", stats.TotalRequests, stats.ParseErrors)
+
+	fmt.Printf("Top IP Addresses:\n")
+	printTopMap(snap.IPs, la.TopCount, "IP", "Requests")
+	fmt.Printf("\nTop Pages:\n")
+	printTopMap(snap.Pages, la.TopCount, "Page", "Requests")
+}
+
+// readHead returns the first n lines of a file
+func readHead(path string, n int) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %w", err)
+	}
+	defer file.Close()
+
+	reader, err := decompress(file)
+	if err != nil {
+		return nil, err
+	}
+	var head []string
+	buffered := bufio.NewReader(reader)
+	for len(head) < n {
+		line, err := readLine(buffered)
+		if err != nil {
+			break
+		}
+		head = append(head, line)
+	}
+	return head, nil
+}
+
+// Tailer follows a growing file from its current end, reopening it when
+// it is truncated or replaced by rename-based rotation
+type Tailer struct {
+	Path     string
+	Interval time.Duration
+	file     *os.File
+	reader   *bufio.Reader
+	offset   int64
+	partial  string
+}
+
+// OpenTailer opens path positioned at its end, like tail -f
+func OpenTailer(path string) (*Tailer, error) {
+	t := &Tailer{Path: path, Interval: 250 * time.Millisecond}
+	if err := t.open(); err != nil {
+		return nil, err
+	}
+	offset, err := t.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		t.Close()
+		return nil, fmt.Errorf("failed to seek %s: %w", path, err)
+	}
+	t.offset = offset
+	return t, nil
+}
+
+func (t *Tailer) open() error {
+	file, err := os.Open(t.Path)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	t.file = file
+	t.reader = bufio.NewReader(file)
+	t.offset = 0
+	t.partial = ""
+	return nil
+}
+
+func (t *Tailer) Close() {
+	if t.file != nil {
+		t.file.Close()
+		t.file = nil
+	}
+}
+
+// Run polls for new lines and sends them until stop is closed
+func (t *Tailer) Run(lines chan<- string, errs chan<- error, stop <-chan struct{}) {
+	ticker := time.NewTicker(t.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := t.poll(lines, stop); err != nil {
+			errs <- err
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// poll reads all complete lines, then checks for truncation and rotation
+func (t *Tailer) poll(lines chan<- string, stop <-chan struct{}) error {
+	if err := t.drain(lines, stop); err != nil {
+		return err
+	}
+
+	current, err := t.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	// Rotation: the path now names a different file. The old one has been
+	// drained above, so switch to the new file from its beginning.
+	if latest, err := os.Stat(t.Path); err == nil && !os.SameFile(current, latest) {
+		t.Close()
+		if err := t.open(); err != nil {
+			return err
+		}
+		return t.drain(lines, stop)
+	}
+
+	// Truncation: the file shrank below what we have read
+	if current.Size() < t.offset {
+		if _, err := t.file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		t.reader.Reset(t.file)
+		t.offset = 0
+		t.partial = ""
+		return t.drain(lines, stop)
+	}
+	return nil
+}
+
+// drain sends every complete line available, keeping a trailing partial
+// line until its newline arrives
+func (t *Tailer) drain(lines chan<- string, stop <-chan struct{}) error {
+	for {
+		chunk, err := t.reader.ReadString('\n')
+		t.offset += int64(len(chunk))
+		if err == io.EOF {
+			t.partial += chunk
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		line := strings.TrimRight(t.partial+chunk, "\r\n")
+		t.partial = ""
+		select {
+		case lines <- line:
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// RollingWindow keeps per-second buckets covering the last Size of traffic
+type RollingWindow struct {
+	Size    time.Duration
+	buckets []windowBucket
+}
+
+type windowBucket struct {
+	second   int64
+	requests int
+	errors   int
+	bytes    int64
+	ips      map[string]int
+	pages    map[string]int
+}
+
+// WindowSnapshot aggregates the buckets still inside the window
+type WindowSnapshot struct {
+	Requests int
+	Errors   int
+	Bytes    int64
+	IPs      map[string]int
+	Pages    map[string]int
+}
+
+func NewRollingWindow(size time.Duration) *RollingWindow {
+	seconds := int(size / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return &RollingWindow{Size: size, buckets: make([]windowBucket, seconds)}
+}
+
+func (w *RollingWindow) Add(now time.Time, entry *LogEntry) {
+	second := now.Unix()
+	b := &w.buckets[second%int64(len(w.buckets))]
+	if b.second != second || b.ips == nil {
+		*b = windowBucket{
+			second: second,
+			ips:    make(map[string]int),
+			pages:  make(map[string]int),
+		}
+	}
+
+	b.requests++
+	b.bytes += entry.Size
+	if entry.Status >= 400 {
+		b.errors++
+	}
+	if entry.IP != "" {
+		b.ips[entry.IP]++
+	}
+	if page := stripQuery(entry.URL); page != "" {
+		b.pages[page]++
+	}
+}
+
+func (w *RollingWindow) Snapshot(now time.Time) WindowSnapshot {
+	snap := WindowSnapshot{IPs: make(map[string]int), Pages: make(map[string]int)}
+	oldest := now.Unix() - int64(len(w.buckets)) + 1
+	for _, b := range w.buckets {
+		if b.ips == nil || b.second < oldest {
+			continue
+		}
+		snap.Requests += b.requests
+		snap.Errors += b.errors
+		snap.Bytes += b.bytes
+		for ip, n := range b.ips {
+			snap.IPs[ip] += n
+		}
+		for page, n := range b.pages {
+			snap.Pages[page] += n
+		}
+	}
+	return snap
+}
+
+// MetricsServer follows a log and serves its running statistics over HTTP:
+// /metrics in the Prometheus text format and /stats as JSON
+type MetricsServer struct {
+	Analyzer *LogAnalyzer
+	Addr     string
+
+	mu       sync.Mutex
+	stats    *Stats
+	requests map[metricKey]*metricCount
+	started  time.Time
+}
+
+// metricKey labels the request and byte counters
+type metricKey struct {
+	Status int
+	Method string
+}
+
+type metricCount struct {
+	Requests int
+	Bytes    int64
+}
+
+func NewMetricsServer(la *LogAnalyzer, addr string) *MetricsServer {
+	return &MetricsServer{
+		Analyzer: la,
+		Addr:     addr,
+		stats:    la.newStats(),
+		requests: make(map[metricKey]*metricCount),
+		started:  time.Now(),
+	}
+}
+
+// Serve tails the log and answers HTTP requests until interrupted
+func (la *LogAnalyzer) Serve(addr string) error {
+	m := NewMetricsServer(la, addr)
+
+	lines := make(chan string, 1024)
+	errs := make(chan error, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	name, closeStream, err := la.openStream(la.Files[0], lines, errs, stop)
+	if err != nil {
+		return err
+	}
+	defer closeStream()
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", m.handleMetrics)
+	mux.HandleFunc("/stats", m.handleStats)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	serveErrs := make(chan error, 1)
+	go func() {
+		serveErrs <- server.Serve(listener)
+	}()
+	fmt.Printf("Following %s, serving metrics on http://%s/metrics\n", name, listener.Addr())
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
+
+	lineNum := 0
+	for {
+		select {
+		case raw := <-lines:
+			lineNum++
+			m.add(name, lineNum, raw)
+		case err := <-errs:
+			server.Close()
+			return fmt.Errorf("error reading %s: %w", name, err)
+		case err := <-serveErrs:
+			return fmt.Errorf("server stopped: %w", err)
+		case <-sigChan:
+			fmt.Println("\nShutting down gracefully...")
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			return server.Shutdown(ctx)
+		}
+	}
+}
+
+// add parses and counts one line under the lock
+func (m *MetricsServer) add(name string, lineNum int, raw string) {
+	la := m.Analyzer
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := la.parseStreamLine(name, lineNum, raw, m.stats)
+	if entry == nil {
+		return
+	}
+	if la.accept(entry) {
+		key := metricKey{Status: entry.Status, Method: entry.Method}
+		count := m.requests[key]
+		if count == nil {
+			count = &metricCount{}
+			m.requests[key] = count
+		}
+		count.Requests++
+		count.Bytes += entry.Size
+	}
+	la.processEntry(entry, m.stats)
+}
+
+// snapshot copies the running stats and finalizes the copy, so anomaly
+// and alert evaluation run without holding up ingestion or changing the
+// live state
+func (m *MetricsServer) snapshot() *Stats {
+	snap := m.Analyzer.newStats()
+	m.mu.Lock()
+	snap.Merge(m.stats)
+	m.mu.Unlock()
+	m.Analyzer.finalize(snap)
+	return snap
+}
+
+// handleStats returns the current Stats snapshot, as -o json would print it
+func (m *MetricsServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	data, err := json.MarshalIndent(m.snapshot(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// handleMetrics writes the counters and histograms in the Prometheus text
+// exposition format
+func (m *MetricsServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+
+	m.mu.Lock()
+	keys := make([]metricKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Status != keys[j].Status {
+			return keys[i].Status < keys[j].Status
+		}
+		return keys[i].Method < keys[j].Method
+	})
+
+	fmt.Fprintf(&buf, "# HELP loganalyzer_requests_total Requests read from the log, by status and method.\n")
+	fmt.Fprintf(&buf, "# TYPE loganalyzer_requests_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(&buf, "loganalyzer_requests_total{status=\"%d\",method=\"%s\"} %d\n",
+			key.Status, escapeLabel(key.Method), m.requests[key].Requests)
+	}
+
+	fmt.Fprintf(&buf, "# HELP loganalyzer_response_bytes_total Response bytes sent, by status and method.\n")
+	fmt.Fprintf(&buf, "# TYPE loganalyzer_response_bytes_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(&buf, "loganalyzer_response_bytes_total{status=\"%d\",method=\"%s\"} %d\n",
+			key.Status, escapeLabel(key.Method), m.requests[key].Bytes)
+	}
+
+	// Cumulative buckets per status class, in seconds
+	fmt.Fprintf(&buf, "# HELP loganalyzer_request_duration_seconds Response times logged, by status class.\n")
+	fmt.Fprintf(&buf, "# TYPE loganalyzer_request_duration_seconds histogram\n")
+	for _, class := range getSortedSketchKeys(m.stats.LatencyByStatus) {
+		sketch := m.stats.LatencyByStatus[class]
+		cumulative := 0
+		for i, n := range sketch.buckets {
+			cumulative += n
+			le := "+Inf"
+			if i < len(latencyBuckets) {
+				le = strconv.FormatFloat(latencyBuckets[i].Seconds(), 'g', -1, 64)
+			}
+			fmt.Fprintf(&buf, "loganalyzer_request_duration_seconds_bucket{status_class=\"%s\",le=\"%s\"} %d\n",
+				class, le, cumulative)
+		}
+		fmt.Fprintf(&buf, "loganalyzer_request_duration_seconds_sum{status_class=\"%s\"} %g\n", class, sketch.Sum.Seconds())
+		fmt.Fprintf(&buf, "loganalyzer_request_duration_seconds_count{status_class=\"%s\"} %d\n", class, sketch.Count)
+	}
+
+	fmt.Fprintf(&buf, "# HELP loganalyzer_parse_errors_total Lines that could not be parsed.\n")
+	fmt.Fprintf(&buf, "# TYPE loganalyzer_parse_errors_total counter\n")
+	fmt.Fprintf(&buf, "loganalyzer_parse_errors_total %d\n", m.stats.ParseErrors)
+
+	fmt.Fprintf(&buf, "# HELP loganalyzer_start_time_seconds Time the server started following the log.\n")
+	fmt.Fprintf(&buf, "# TYPE loganalyzer_start_time_seconds gauge\n")
+	fmt.Fprintf(&buf, "loganalyzer_start_time_seconds %d\n", m.started.Unix())
+	m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// escapeLabel escapes a Prometheus label value
+func escapeLabel(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	return strings.ReplaceAll(value, "\n", `\n`)
+}
+
+// newParser builds the parser for a -format value. It returns nil for
+// "auto", leaving the choice to detectParser.
+func newParser(cfg ParserConfig) (Parser, error) {
+	if cfg.Pattern != "" {
+		return NewCustomParser(cfg.Pattern, cfg.TimeLayout)
+	}
+
+	switch format := cfg.Format; format {
+	case "auto", "":
+		return nil, nil
+	case "combined", "common", "apache":
+		return &RegexParser{name: format, pattern: combinedPattern}, nil
+	case "nginx":
+		return NewNginxParser(cfg.NginxFormat)
+	case "json", "jsonl":
+		mapping, err := parseFieldMapping(cfg.JSONFields)
+		if err != nil {
+			return nil, err
+		}
+		return &JSONParser{Fields: mapping}, nil
+	case "syslog":
+		return &SyslogParser{}, nil
+	default:
+		return nil, fmt.Errorf("unknown format %q (use auto, combined, common, nginx, json, or syslog)", format)
+	}
+}
+
+// detectParser picks the built-in parser that understands most of the
+// sample lines, falling back to the combined format.
+func detectParser(lines []string) Parser {
+	candidates := []Parser{
+		&RegexParser{name: "combined", pattern: combinedPattern},
+		&JSONParser{},
+		&SyslogParser{},
+	}
+
+	var best Parser = candidates[0]
+	bestCount := 0
+	for _, candidate := range candidates {
+		count := 0
+		for _, line := range lines {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			if _, err := candidate.Parse(line); err == nil {
+				count++
+			}
+		}
+		if count > bestCount {
+			best, bestCount = candidate, count
+		}
+	}
+	return best
+}
+
+// RegexParser parses Apache common/combined lines, or lines matching a
+// custom pattern. Custom patterns map fields by named groups; a pattern
+// without names must use the combined group layout.
+type RegexParser struct {
+	name       string
+	pattern    *regexp.Regexp
+	timeLayout string
+	named      bool
+}
+
+// Named groups recognised by custom patterns, and their LogEntry field
+var namedGroupAliases = map[string]string{
+	"ip":           "ip",
+	"remote_addr":  "ip",
+	"client":       "ip",
+	"time":         "time",
+	"timestamp":    "time",
+	"method":       "method",
+	"url":          "url",
+	"uri":          "url",
+	"path":         "url",
+	"protocol":     "protocol",
+	"proto":        "protocol",
+	"request":      "request",
+	"status":       "status",
+	"code":         "status",
+	"size":         "size",
+	"bytes":        "size",
+	"referer":      "referer",
+	"referrer":     "referer",
+	"user_agent":   "user_agent",
+	"agent":        "user_agent",
+	"ua":           "user_agent",
+	"host":         "host",
+	"duration":     "duration",
+	"latency":      "duration",
+	"request_time": "duration",
+	"duration_ms":  "duration_ms",
+	"duration_us":  "duration_us",
+	"D":            "duration_us",
+	"program":      "program",
+	"message":      "message",
+	"msg":          "message",
+}
+
+// NewCustomParser compiles a -p pattern, reporting syntax errors and
+// patterns that cannot yield a timestamp
+func NewCustomParser(expr, timeLayout string) (*RegexParser, error) {
+	pattern, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid custom pattern: %w", err)
+	}
+
+	parser := &RegexParser{name: "custom", pattern: pattern, timeLayout: timeLayout}
+	hasTime := false
+	for _, name := range pattern.SubexpNames()[1:] {
+		if name == "" {
+			continue
+		}
+		parser.named = true
+		if namedGroupAliases[name] == "time" {
+			hasTime = true
+		}
+	}
+
+	switch {
+	case parser.named && !hasTime:
+		return nil, fmt.Errorf("invalid custom pattern: missing a (?P<time>...) group")
+	case !parser.named && pattern.NumSubexp() < 8:
+		return nil, fmt.Errorf("invalid custom pattern: use named groups like (?P<ip>...) or the 9 combined-format groups (found %d)", pattern.NumSubexp())
+	}
+	return parser, nil
+}
+
+func (p *RegexParser) Name() string {
+	return p.name
+}
+
+func (p *RegexParser) Parse(line string) (*LogEntry, error) {
+	if p.named {
+		return p.parseNamed(line)
+	}
+
+	matches := p.pattern.FindStringSubmatch(line)
+	if len(matches) < 9 {
+		return nil, fmt.Errorf("line doesn't match expected format")
+	}
+
+	// Parse IP
+	ip := matches[1]
+
+	// Parse timestamp
+	timestampStr := matches[2]
+	timestamp, err := p.parseTime(timestampStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp format: %w", err)
+	}
+
+	// Parse request components
+	method := matches[3]
+	url := matches[4]
+	protocol := matches[5]
+
+	// Parse status code
+	status, err := strconv.Atoi(matches[6])
+	if err != nil {
+		return nil, fmt.Errorf("invalid status code: %w", err)
+	}
+
+	// Parse size
+	var size int64
+	if matches[7] != "-" {
+		size, err = strconv.ParseInt(matches[7], 10, 64)
+		if err != nil {
+			size = 0 // Ignore size parsing errors
+		}
+	}
+
+	// Parse referer and user agent (optional fields)
+	var referer, userAgent string
+	if len(matches) > 8 {
+		referer = matches[8]
+	}
+	if len(matches) > 9 {
+		userAgent = matches[9]
+	}
+
+	entry := &LogEntry{
+		IP:        ip,
+		Timestamp: timestamp,
+		Method:    method,
+		URL:       url,
+		Protocol:  protocol,
+		Status:    status,
+		Size:      size,
+		Referer:   referer,
+		UserAgent: userAgent,
+	}
+
+	// Trailing response time: integers are %D microseconds, decimals are
+	// $request_time seconds
+	if len(matches) > 10 && matches[10] != "" {
+		unit := time.Microsecond
+		if strings.Contains(matches[10], ".") {
+			unit = time.Second
+		}
+		entry.Duration, entry.Timed = parseLatency(matches[10], unit)
+	}
+	return entry, nil
+}
+
+// parseNamed fills a LogEntry from the named groups of a custom pattern.
+// Groups that are not LogEntry fields are kept in Fields.
+func (p *RegexParser) parseNamed(line string) (*LogEntry, error) {
+	matches := p.pattern.FindStringSubmatch(line)
+	if matches == nil {
+		return nil, fmt.Errorf("line doesn't match custom pattern")
+	}
+
+	entry := &LogEntry{}
+	var err error
+	for i, name := range p.pattern.SubexpNames() {
+		value := matches[i]
+		if i == 0 || name == "" || value == "" || value == "-" {
+			continue
+		}
+
+		switch namedGroupAliases[name] {
+		case "ip":
+			entry.IP = value
+		case "time":
+			entry.Timestamp, err = p.parseTime(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timestamp format: %w", err)
+			}
+		case "method":
+			entry.Method = value
+		case "url":
+			entry.URL = value
+		case "protocol":
+			entry.Protocol = value
+		case "request":
+			entry.Method, entry.URL, entry.Protocol = splitRequest(value)
+		case "status":
+			entry.Status, err = strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid status code: %w", err)
+			}
+		case "size":
+			entry.Size, _ = strconv.ParseInt(value, 10, 64)
+		case "referer":
+			entry.Referer = value
+		case "user_agent":
+			entry.UserAgent = value
+		case "host":
+			entry.Host = value
+		case "duration":
+			entry.Duration, entry.Timed = parseLatency(value, time.Second)
+		case "duration_ms":
+			entry.Duration, entry.Timed = parseLatency(value, time.Millisecond)
+		case "duration_us":
+			entry.Duration, entry.Timed = parseLatency(value, time.Microsecond)
+		case "program":
+			entry.Program = value
+		case "message":
+			entry.Message = value
+		default:
+			if entry.Fields == nil {
+				entry.Fields = make(map[string]string)
+			}
+			entry.Fields[name] = value
+		}
+	}
+
+	if entry.Timestamp.IsZero() {
+		return nil, fmt.Errorf("line has no timestamp")
+	}
+	return entry, nil
+}
+
+// parseTime parses a timestamp with the configured layout
+func (p *RegexParser) parseTime(value string) (time.Time, error) {
+	switch p.timeLayout {
+	case "", clfTimeLayout:
+		return time.Parse(clfTimeLayout, value)
+	case "unix":
+		return parseEpoch(value)
+	case "auto":
+		return parseFlexibleTime(value)
+	default:
+		return time.Parse(p.timeLayout, value)
+	}
+}
+
+// NginxParser parses lines written with an nginx log_format definition
+type NginxParser struct {
+	format  string
+	pattern *regexp.Regexp
+	vars    []string
+}
+
+// NewNginxParser compiles a log_format string such as
+// `$remote_addr - $remote_user [$time_local] "$request" $status ...`.
+func NewNginxParser(format string) (*NginxParser, error) {
+	varPattern := regexp.MustCompile(`\$\{?([a-zA-Z_][a-zA-Z0-9_]*)\}?`)
+	locs := varPattern.FindAllStringSubmatchIndex(format, -1)
+	if len(locs) == 0 {
+		return nil, fmt.Errorf("log_format contains no variables: %q", format)
+	}
+
+	var re strings.Builder
+	var vars []string
+	re.WriteString("^")
+	prev := 0
+	for i, loc := range locs {
+		re.WriteString(regexp.QuoteMeta(format[prev:loc[0]]))
+		vars = append(vars, format[loc[2]:loc[3]])
+
+		// A variable extends up to the next literal character
+		next := len(format)
+		if i+1 < len(locs) {
+			next = locs[i+1][0]
+		}
+		switch {
+		case loc[1] == len(format):
+			re.WriteString("(.*)")
+		case loc[1] == next:
+			re.WriteString(`(\S*)`)
+		default:
+			re.WriteString("([^" + regexp.QuoteMeta(format[loc[1]:loc[1]+1]) + "]*)")
+		}
+		prev = loc[1]
+	}
+	re.WriteString(regexp.QuoteMeta(format[prev:]))
+	re.WriteString("$")
+
+	pattern, err := regexp.Compile(re.String())
+	if err != nil {
+		return nil, fmt.Errorf("cannot compile log_format: %w", err)
+	}
+	return &NginxParser{format: format, pattern: pattern, vars: vars}, nil
+}
+
+func (p *NginxParser) Name() string {
+	return "nginx"
+}
+
+func (p *NginxParser) Parse(line string) (*LogEntry, error) {
+	matches := p.pattern.FindStringSubmatch(line)
+	if matches == nil {
+		return nil, fmt.Errorf("line doesn't match log_format")
+	}
+
+	entry := &LogEntry{}
+	var err error
+	for i, name := range p.vars {
+		value := matches[i+1]
+		if value == "-" {
+			continue
+		}
+
+		switch name {
+		case "remote_addr", "realip_remote_addr", "http_x_real_ip":
+			entry.IP = value
+		case "http_x_forwarded_for":
+			if entry.IP == "" {
+				entry.IP = strings.TrimSpace(strings.Split(value, ",")[0])
+			}
+		case "time_local":
+			entry.Timestamp, err = time.Parse(clfTimeLayout, value)
+		case "time_iso8601":
+			entry.Timestamp, err = time.Parse(time.RFC3339, value)
+		case "msec":
+			entry.Timestamp, err = parseEpoch(value)
+		case "request":
+			entry.Method, entry.URL, entry.Protocol = splitRequest(value)
+		case "request_method":
+			entry.Method = value
+		case "request_uri", "uri":
+			entry.URL = value
+		case "server_protocol":
+			entry.Protocol = value
+		case "status":
+			entry.Status, err = strconv.Atoi(value)
+		case "body_bytes_sent", "bytes_sent":
+			entry.Size, _ = strconv.ParseInt(value, 10, 64)
+		case "http_referer":
+			entry.Referer = value
+		case "http_user_agent":
+			entry.UserAgent = value
+		case "host", "server_name":
+			entry.Host = value
+		case "request_time":
+			entry.Duration, entry.Timed = parseLatency(value, time.Second)
+		case "upstream_response_time":
+			// Retried upstreams log "0.010, 0.200"; the request time wins
+			if !entry.Timed {
+				var total time.Duration
+				for _, part := range strings.Split(value, ",") {
+					d, ok := parseLatency(strings.TrimSpace(part), time.Second)
+					if ok {
+						total += d
+						entry.Timed = true
+					}
+				}
+				entry.Duration = total
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid $%s: %w", name, err)
+		}
+	}
+
+	if entry.Timestamp.IsZero() {
+		return nil, fmt.Errorf("log_format has no usable time variable")
+	}
+	return entry, nil
+}
+
+// splitRequest splits a request line like "GET /index.html HTTP/1.1"
+func splitRequest(request string) (method, url, protocol string) {
+	parts := strings.Fields(request)
+	switch len(parts) {
+	case 0:
+	case 1:
+		url = parts[0]
+	case 2:
+		method, url = parts[0], parts[1]
+	default:
+		method, url, protocol = parts[0], parts[1], parts[2]
+	}
+	return
+}
+
+// JSONParser reads one JSON object per line. Fields maps LogEntry fields
+// (ip, time, method, url, protocol, request, status, size, referer,
+// user_agent, host) to dotted paths in the object; unmapped fields are
+// looked up under common names. Any other name in Fields becomes an extra
+// field of the entry.
+type JSONParser struct {
+	Fields map[string]string
+}
+
+var jsonFieldCandidates = map[string][]string{
+	"ip":         {"ip", "remote_addr", "client_ip", "clientip", "remote_ip", "client"},
+	"time":       {"time", "timestamp", "@timestamp", "ts", "time_local", "datetime"},
+	"method":     {"method", "request_method", "http_method"},
+	"url":        {"url", "uri", "path", "request_uri"},
+	"protocol":   {"protocol", "server_protocol", "http_version"},
+	"request":    {"request"},
+	"status":     {"status", "status_code", "response_code", "code"},
+	"size":       {"size", "bytes", "body_bytes_sent", "bytes_sent", "response_size"},
+	"referer":    {"referer", "referrer", "http_referer"},
+	"user_agent": {"user_agent", "http_user_agent", "agent", "ua"},
+	"host":       {"host", "hostname", "server_name"},
+	"duration":   {"duration", "request_time", "latency", "response_time", "elapsed"},
+}
+
+// Millisecond duration keys, checked when no duration in seconds is found
+var jsonMillisecondKeys = []string{"duration_ms", "latency_ms", "response_time_ms", "elapsed_ms"}
+
+// parseFieldMapping parses "ip=client.ip,time=@timestamp" into a map
+func parseFieldMapping(spec string) (map[string]string, error) {
+	mapping := make(map[string]string)
+	if spec == "" {
+		return mapping, nil
+	}
+
+	for _, pair := range strings.Split(spec, ",") {
+		field, path, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || path == "" {
+			return nil, fmt.Errorf("invalid JSON field mapping %q (use field=path)", pair)
+		}
+		mapping[field] = path
+	}
+	return mapping, nil
+}
+
+func (p *JSONParser) Name() string {
+	return "json"
+}
+
+func (p *JSONParser) Parse(line string) (*LogEntry, error) {
+	if !strings.HasPrefix(line, "{") {
+		return nil, fmt.Errorf("line is not a JSON object")
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(line))
+	decoder.UseNumber()
+	var obj map[string]interface{}
+	if err := decoder.Decode(&obj); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	get := func(field string) string {
+		if path, ok := p.Fields[field]; ok {
+			return jsonString(lookupJSONPath(obj, path))
+		}
+		for _, key := range jsonFieldCandidates[field] {
+			if value, ok := obj[key]; ok {
+				return jsonString(value)
+			}
+		}
+		return ""
+	}
+
+	entry := &LogEntry{
+		IP:        get("ip"),
+		Method:    get("method"),
+		URL:       get("url"),
+		Protocol:  get("protocol"),
+		Referer:   get("referer"),
+		UserAgent: get("user_agent"),
+		Host:      get("host"),
+	}
+	if request := get("request"); request != "" && entry.URL == "" {
+		entry.Method, entry.URL, entry.Protocol = splitRequest(request)
+	}
+	for field, path := range p.Fields {
+		if _, builtin := jsonFieldCandidates[field]; builtin {
+			continue
+		}
+		if entry.Fields == nil {
+			entry.Fields = make(map[string]string)
+		}
+		entry.Fields[field] = jsonString(lookupJSONPath(obj, path))
+	}
+
+	timestamp := get("time")
+	if timestamp == "" {
+		return nil, fmt.Errorf("missing time field")
+	}
+	var err error
+	entry.Timestamp, err = parseFlexibleTime(timestamp)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp format: %w", err)
+	}
+
+	if status := get("status"); status != "" {
+		entry.Status, err = strconv.Atoi(status)
+		if err != nil {
+			return nil, fmt.Errorf("invalid status code: %w", err)
+		}
+	}
+	if size := get("size"); size != "" {
+		entry.Size, _ = strconv.ParseInt(size, 10, 64)
+	}
+	if duration := get("duration"); duration != "" {
+		entry.Duration, entry.Timed = parseLatency(duration, time.Second)
+	} else if _, mapped := p.Fields["duration"]; !mapped {
+		for _, key := range jsonMillisecondKeys {
+			if value, ok := obj[key]; ok {
+				entry.Duration, entry.Timed = parseLatency(jsonString(value), time.Millisecond)
+				break
+			}
+		}
+	}
+
+	return entry, nil
+}
+
+// lookupJSONPath follows a dotted path through nested objects. A key that
+// itself contains dots (like "@timestamp" or "http.status") is tried first.
+func lookupJSONPath(obj map[string]interface{}, path string) interface{} {
+	if value, ok := obj[path]; ok {
+		return value
+	}
+	head, rest, ok := strings.Cut(path, ".")
+	if !ok {
+		return nil
+	}
+	nested, isObj := obj[head].(map[string]interface{})
+	if !isObj {
+		return nil
+	}
+	return lookupJSONPath(nested, rest)
+}
+
+func jsonString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+}
+
+// parseLatency reads a bare number in the given unit, or a Go duration
+// string such as "120ms"
+func parseLatency(value string, unit time.Duration) (time.Duration, bool) {
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		if f < 0 {
+			return 0, false
+		}
+		return time.Duration(f * float64(unit)), true
+	}
+	if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+		return d, true
+	}
+	return 0, false
+}
+
+// Time layouts accepted in JSON and syslog messages
+var flexibleTimeLayouts = []string{
+	time.RFC3339Nano,
+	clfTimeLayout,
+	"2006-01-02 15:04:05.999999999 -0700",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+}
+
+func parseFlexibleTime(value string) (time.Time, error) {
+	for _, layout := range flexibleTimeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	if t, err := parseEpoch(value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("unrecognized time %q", value)
+}
+
+// parseEpoch reads Unix seconds (possibly fractional) or milliseconds
+func parseEpoch(value string) (time.Time, error) {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if f > 1e12 {
+		f /= 1000
+	}
+	sec := int64(f)
+	return time.Unix(sec, int64((f-float64(sec))*1e9)).UTC(), nil
+}
+
+// SyslogParser reads RFC 3164 and RFC 5424 syslog lines. When the message
+// is itself an access log line (combined or JSON) its request fields are
+// used; otherwise the entry carries only the syslog metadata.
+type SyslogParser struct{}
+
+var (
+	rfc5424Pattern = regexp.MustCompile(`^<(\d{1,3})>1 (\S+) (\S+) (\S+) (\S+) (\S+) (-|(?:\[.*?\])+) ?(.*)$`)
+	rfc3164Pattern = regexp.MustCompile(`^<(\d{1,3})>([A-Z][a-z]{2} [ \d]\d \d{2}:\d{2}:\d{2}) (\S+) ([^:\[\s]+)(?:\[\d+\])?: ?(.*)$`)
+	syslogInner    = []Parser{&RegexParser{name: "combined", pattern: combinedPattern}, &JSONParser{}}
+)
+
+func (p *SyslogParser) Name() string {
+	return "syslog"
+}
+
+func (p *SyslogParser) Parse(line string) (*LogEntry, error) {
+	var timestamp time.Time
+	var host, program, message string
+
+	if m := rfc5424Pattern.FindStringSubmatch(line); m != nil {
+		t, err := time.Parse(time.RFC3339Nano, m[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp format: %w", err)
+		}
+		timestamp, host, program, message = t, m[3], m[4], strings.TrimPrefix(m[8], "\ufeff")
+	} else if m := rfc3164Pattern.FindStringSubmatch(line); m != nil {
+		t, err := time.Parse(time.Stamp, m[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp format: %w", err)
+		}
+		timestamp, host, program, message = withCurrentYear(t), m[3], m[4], m[5]
+	} else {
+		return nil, fmt.Errorf("line is not a syslog message")
+	}
+
+	if host == "-" {
+		host = ""
+	}
+	if program == "-" {
+		program = ""
+	}
+
+	for _, inner := range syslogInner {
+		if entry, err := inner.Parse(message); err == nil {
+			entry.Host, entry.Program = host, program
+			return entry, nil
+		}
+	}
+
+	return &LogEntry{
+		Timestamp: timestamp,
+		Host:      host,
+		Program:   program,
+		Message:   message,
+	}, nil
+}
+
+// withCurrentYear fills in the year missing from RFC 3164 timestamps,
+// assuming dates more than a day in the future belong to last year
+func withCurrentYear(t time.Time) time.Time {
+	now := time.Now()
+	t = time.Date(now.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.Local)
+	if t.After(now.Add(24 * time.Hour)) {
+		t = t.AddDate(-1, 0, 0)
+	}
+	return t
+}
+
+func (la *LogAnalyzer) isWithinTimeRange(timestamp time.Time) bool {
+	if !la.StartTime.IsZero() && timestamp.Before(la.StartTime) {
+		return false
+	}
+	if !la.EndTime.IsZero() && timestamp.After(la.EndTime) {
+		return false
+	}
+	return true
+}
+
+// enrich adds -ipdb information before filtering, so -where can use it
+func (la *LogAnalyzer) enrich(entry *LogEntry) {
+	if la.Enricher != nil {
+		la.Enricher.Enrich(entry)
+	}
+}
+
+// accept reports whether an entry passes the time range and -where filter
+func (la *LogAnalyzer) accept(entry *LogEntry) bool {
+	if !la.isWithinTimeRange(entry.Timestamp) {
+		return false
+	}
+	return la.Where == nil || la.Where.Match(entry)
+}
+
+// IPInfo is what an IP database knows about an address
+type IPInfo struct {
+	Country string
+	ASN     string
+	Org     string
+	Label   string
+}
+
+// merge fills the fields still empty from other
+func (info *IPInfo) merge(other IPInfo) {
+	if info.Country == "" {
+		info.Country = other.Country
+	}
+	if info.ASN == "" {
+		info.ASN = other.ASN
+	}
+	if info.Org == "" {
+		info.Org = other.Org
+	}
+	if info.Label == "" {
+		info.Label = other.Label
+	}
+}
+
+// IPDatabase looks addresses up in a local range database
+type IPDatabase interface {
+	Lookup(ip net.IP) (IPInfo, bool)
+}
+
+// Enricher adds country, ASN and label to entries from one or more
+// databases. Earlier databases win for each field, so a CSV of labels can
+// be combined with MaxMind country and ASN files.
+type Enricher struct {
+	Databases []IPDatabase
+}
+
+// OpenEnricher loads each path as an .mmdb file or a CIDR CSV
+func OpenEnricher(paths []string) (*Enricher, error) {
+	e := &Enricher{}
+	for _, path := range paths {
+		var db IPDatabase
+		var err error
+		if strings.EqualFold(filepath.Ext(path), ".mmdb") {
+			db, err = OpenMMDB(path)
+		} else {
+			db, err = LoadCIDRDatabase(path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		e.Databases = append(e.Databases, db)
+	}
+	return e, nil
+}
+
+// Enrich sets the entry's country, ASN, org and label
+func (e *Enricher) Enrich(entry *LogEntry) {
+	ip := net.ParseIP(entry.IP)
+	if ip == nil {
+		return
+	}
+	var info IPInfo
+	for _, db := range e.Databases {
+		if found, ok := db.Lookup(ip); ok {
+			info.merge(found)
+		}
+	}
+	entry.Country = info.Country
+	entry.ASN = info.ASN
+	entry.Org = info.Org
+	entry.Label = info.Label
+}
+
+// networkName is the top-list key for an entry's network, such as
+// "AS15169 GOOGLE"
+func networkName(entry *LogEntry) string {
+	if entry.Org == "" {
+		return entry.ASN
+	}
+	if entry.ASN == "" {
+		return entry.Org
+	}
+	return entry.ASN + " " + entry.Org
+}
+
+// CIDRDatabase is a CSV of networks with a header naming its columns:
+// network (or cidr), and any of country, asn, org and label. The most
+// specific matching network wins.
+type CIDRDatabase struct {
+	prefixes []int
+	networks map[int]map[string]IPInfo
+}
+
+func LoadCIDRDatabase(path string) (*CIDRDatabase, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open IP database: %w", err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	networkCol, ok := columns["network"]
+	if !ok {
+		if networkCol, ok = columns["cidr"]; !ok {
+			return nil, fmt.Errorf("%s: header needs a network or cidr column", path)
+		}
+	}
+	column := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	db := &CIDRDatabase{networks: make(map[int]map[string]IPInfo)}
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+
+		network := column(record, header[networkCol])
+		if network == "" {
+			continue
+		}
+		// A bare address is a single-host network
+		if !strings.Contains(network, "/") {
+			if strings.Contains(network, ":") {
+				network += "/128"
+			} else {
+				network += "/32"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+
+		asn := column(record, "asn")
+		if asn != "" && !strings.HasPrefix(strings.ToUpper(asn), "AS") {
+			asn = "AS" + asn
+		}
+		info := IPInfo{
+			Country: strings.ToUpper(column(record, "country")),
+			ASN:     asn,
+			Org:     column(record, "org"),
+			Label:   column(record, "label"),
+		}
+
+		ones, bits := ipnet.Mask.Size()
+		prefix := ones
+		if bits == 32 {
+			prefix += 96
+		}
+		if db.networks[prefix] == nil {
+			db.networks[prefix] = make(map[string]IPInfo)
+			db.prefixes = append(db.prefixes, prefix)
+		}
+		db.networks[prefix][string(ipnet.IP.To16())] = info
+	}
+
+	// Try the longest prefixes first
+	sort.Sort(sort.Reverse(sort.IntSlice(db.prefixes)))
+	return db, nil
+}
+
+func (db *CIDRDatabase) Lookup(ip net.IP) (IPInfo, bool) {
+	ip = ip.To16()
+	for _, prefix := range db.prefixes {
+		mask := net.CIDRMask(prefix, 128)
+		if info, ok := db.networks[prefix][string(ip.Mask(mask))]; ok {
+			return info, true
+		}
+	}
+	return IPInfo{}, false
+}
+
+// MaxMind DB files end with this marker followed by the metadata map
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// MMDB reads MaxMind DB files such as GeoLite2-Country and GeoLite2-ASN.
+// The whole file is loaded into memory.
+type MMDB struct {
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	dataStart  uint
+	ipv4Start  uint
+}
+
+func OpenMMDB(path string) (*MMDB, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open IP database: %w", err)
+	}
+
+	idx := bytes.LastIndex(data, mmdbMetadataMarker)
+	if idx < 0 {
+		return nil, fmt.Errorf("%s: not a MaxMind DB file", path)
+	}
+	metaStart := uint(idx + len(mmdbMetadataMarker))
+	meta := &mmdbDecoder{data: data[metaStart:]}
+	value, _, err := meta.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: bad metadata: %w", path, err)
+	}
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: bad metadata", path)
+	}
+
+	db := &MMDB{
+		data:       data,
+		nodeCount:  mmdbUint(fields["node_count"]),
+		recordSize: mmdbUint(fields["record_size"]),
+		ipVersion:  mmdbUint(fields["ip_version"]),
+	}
+	switch db.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("%s: unsupported record size %d", path, db.recordSize)
+	}
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+16 > metaStart {
+		return nil, fmt.Errorf("%s: search tree larger than file", path)
+	}
+	db.dataStart = treeSize + 16
+
+	// IPv4 addresses live under ::/96 in IPv6 databases
+	if db.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < db.nodeCount; i++ {
+			node = db.record(node, 0)
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of a node
+func (db *MMDB) record(node, bit uint) uint {
+	size := db.recordSize / 4
+	b := db.data[node*size : (node+1)*size]
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		b = b[bit*4:]
+		return uint(b[0])<<24 | uint(b[1])<<16 | uint(b[2])<<8 | uint(b[3])
+	}
+}
+
+func (db *MMDB) Lookup(ip net.IP) (IPInfo, bool) {
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		if db.ipVersion == 6 {
+			node = db.ipv4Start
+		}
+	} else if db.ipVersion == 4 {
+		return IPInfo{}, false
+	}
+
+	for i := 0; i < len(ip)*8 && node < db.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		node = db.record(node, bit)
+	}
+	if node <= db.nodeCount {
+		return IPInfo{}, false
+	}
+
+	decoder := &mmdbDecoder{data: db.data[db.dataStart:]}
+	value, _, err := decoder.decode(node - db.nodeCount - 16)
+	if err != nil {
+		return IPInfo{}, false
+	}
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return IPInfo{}, false
+	}
+	return mmdbInfo(fields), true
+}
+
+// mmdbInfo reads the GeoIP2/GeoLite2 layout, with fallbacks for the flat
+// layouts other vendors use
+func mmdbInfo(fields map[string]interface{}) IPInfo {
+	var info IPInfo
+	for _, key := range []string{"country", "registered_country"} {
+		switch country := fields[key].(type) {
+		case map[string]interface{}:
+			if code, ok := country["iso_code"].(string); ok && info.Country == "" {
+				info.Country = code
+			}
+		case string:
+			if info.Country == "" {
+				info.Country = country
+			}
+		}
+	}
+	if code, ok := fields["country_code"].(string); ok && info.Country == "" {
+		info.Country = code
+	}
+
+	if n := mmdbUint(fields["autonomous_system_number"]); n > 0 {
+		info.ASN = "AS" + strconv.FormatUint(uint64(n), 10)
+	} else if asn, ok := fields["asn"].(string); ok {
+		info.ASN = asn
+	}
+	for _, key := range []string{"autonomous_system_organization", "as_name", "org"} {
+		if org, ok := fields[key].(string); ok && info.Org == "" {
+			info.Org = org
+		}
+	}
+	if label, ok := fields["label"].(string); ok {
+		info.Label = label
+	}
+	return info
+}
+
+// mmdbUint converts any decoded unsigned integer
+func mmdbUint(value interface{}) uint {
+	switch n := value.(type) {
+	case uint64:
+		return uint(n)
+	case int64:
+		return uint(n)
+	}
+	return 0
+}
+
+// mmdbDecoder decodes the MaxMind DB data section format. Offsets are
+// relative to the start of data.
+type mmdbDecoder struct {
+	data []byte
+}
+
+// Data section field types
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+// decode returns the value at offset and the offset just past it
+func (d *mmdbDecoder) decode(offset uint) (interface{}, uint, error) {
+	kind, size, offset, err := d.control(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if kind == mmdbPointer {
+		target, next, err := d.pointer(size, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := d.decode(target)
+		return value, next, err
+	}
+
+	switch kind {
+	case mmdbMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			var key, value interface{}
+			key, offset, err = d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			value, offset, err = d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("map key at %d is not a string", offset)
+			}
+			m[name] = value
+		}
+		return m, offset, nil
+	case mmdbArray:
+		array := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			var value interface{}
+			value, offset, err = d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			array = append(array, value)
+		}
+		return array, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(d.data)) {
+		return nil, 0, fmt.Errorf("value at %d runs past the end of the data", offset)
+	}
+	b := d.data[offset : offset+size]
+	next := offset + size
+	switch kind {
+	case mmdbString:
+		return string(b), next, nil
+	case mmdbBytes:
+		return append([]byte(nil), b...), next, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("bad double size %d", size)
+		}
+		return math.Float64frombits(uint64(mmdbBigEndian(b))), next, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("bad float size %d", size)
+		}
+		return float64(math.Float32frombits(uint32(mmdbBigEndian(b)))), next, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		return mmdbBigEndian(b), next, nil
+	case mmdbInt32:
+		return int64(int32(uint32(mmdbBigEndian(b)))), next, nil
+	case mmdbUint128:
+		// Too large for the fields we read; keep the raw bytes
+		return append([]byte(nil), b...), next, nil
+	}
+	return nil, 0, fmt.Errorf("unknown type %d at %d", kind, offset)
+}
+
+// control reads a field's control byte, returning its type, its size (or
+// the pointer bits) and the offset of its payload
+func (d *mmdbDecoder) control(offset uint) (uint, uint, uint, error) {
+	if offset >= uint(len(d.data)) {
+		return 0, 0, 0, fmt.Errorf("offset %d past the end of the data", offset)
+	}
+	ctrl := d.data[offset]
+	offset++
+	kind := uint(ctrl >> 5)
+	if kind == mmdbPointer {
+		return kind, uint(ctrl & 0x1f), offset, nil
+	}
+	if kind == mmdbExtended {
+		if offset >= uint(len(d.data)) {
+			return 0, 0, 0, fmt.Errorf("truncated extended type at %d", offset)
+		}
+		kind = 7 + uint(d.data[offset])
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(d.data)) {
+			return 0, 0, 0, fmt.Errorf("truncated size at %d", offset)
+		}
+		extra := uint(mmdbBigEndian(d.data[offset : offset+n]))
+		offset += n
+		switch n {
+		case 1:
+			size = 29 + extra
+		case 2:
+			size = 285 + extra
+		default:
+			size = 65821 + extra
+		}
+	}
+	return kind, size, offset, nil
+}
+
+// pointer decodes a pointer whose control bits are ctrl, returning the
+// target offset and the offset after the pointer
+func (d *mmdbDecoder) pointer(ctrl, offset uint) (uint, uint, error) {
+	n := (ctrl>>3)&3 + 1
+	if offset+n > uint(len(d.data)) {
+		return 0, 0, fmt.Errorf("truncated pointer at %d", offset)
+	}
+	value := uint(mmdbBigEndian(d.data[offset : offset+n]))
+	switch n {
+	case 1:
+		value |= (ctrl & 7) << 8
+	case 2:
+		value = ((ctrl&7)<<16 | value) + 2048
+	case 3:
+		value = ((ctrl&7)<<24 | value) + 526336
+	}
+	return value, offset + n, nil
+}
+
+func mmdbBigEndian(b []byte) uint64 {
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n
+}
+
+// Filter is a compiled -where expression
+type Filter interface {
+	Match(entry *LogEntry) bool
+}
+
+type andFilter struct{ left, right Filter }
+type orFilter struct{ left, right Filter }
+type notFilter struct{ inner Filter }
+
+func (f andFilter) Match(e *LogEntry) bool { return f.left.Match(e) && f.right.Match(e) }
+func (f orFilter) Match(e *LogEntry) bool  { return f.left.Match(e) || f.right.Match(e) }
+func (f notFilter) Match(e *LogEntry) bool { return !f.inner.Match(e) }
+
+// compareFilter tests one field against a literal. Values that look like
+// numbers, durations or times are converted once when the filter is parsed.
+type compareFilter struct {
+	field    string
+	op       string
+	value    string
+	number   float64
+	isNumber bool
+	when     time.Time
+	pattern  *regexp.Regexp
+	list     []string
+	nets     []*net.IPNet
+}
+
+func (f *compareFilter) Match(e *LogEntry) bool {
+	actual, ok := e.Field(f.field)
+	if !ok {
+		// A missing field matches only negative tests
+		return f.op == "!=" || f.op == "!~"
+	}
+
+	switch f.op {
+	case "~":
+		return f.pattern.MatchString(actual)
+	case "!~":
+		return !f.pattern.MatchString(actual)
+	case "in":
+		return f.contains(actual)
+	}
+
+	cmp := 0
+	switch {
+	case f.field == "time":
+		switch {
+		case e.Timestamp.Before(f.when):
+			cmp = -1
+		case e.Timestamp.After(f.when):
+			cmp = 1
+		}
+	case f.isNumber:
+		n, err := strconv.ParseFloat(actual, 64)
+		if err != nil {
+			return f.op == "!="
+		}
+		switch {
+		case n < f.number:
+			cmp = -1
+		case n > f.number:
+			cmp = 1
+		}
+	default:
+		cmp = strings.Compare(actual, f.value)
+	}
+
+	switch f.op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default: // ">="
+		return cmp >= 0
+	}
+}
+
+func (f *compareFilter) contains(actual string) bool {
+	for _, item := range f.list {
+		if actual == item {
+			return true
+		}
+	}
+	if len(f.nets) > 0 {
+		if ip := net.ParseIP(actual); ip != nil {
+			for _, network := range f.nets {
+				if network.Contains(ip) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// ParseFilter compiles a -where expression:
+//
+//	expr    = and { "||" and }
+//	and     = unary { "&&" unary }
+//	unary   = "!" unary | "(" expr ")" | field op value | field "in" set
+//	set     = value | "(" value { "," value } ")"
+//
+// Fields must be built-in LogEntry fields or one of the extra fields the
+// log format provides.
+func ParseFilter(expr string, extra []string) (Filter, error) {
+	tokens, err := tokenizeFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens, fields: make(map[string]bool)}
+	for _, field := range filterFields {
+		p.fields[field] = true
+	}
+	for _, field := range extra {
+		p.fields[field] = true
+	}
+	filter, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+	}
+	return filter, nil
+}
+
+type filterTokenKind int
+
+const (
+	tokEOF filterTokenKind = iota
+	tokWord
+	tokString
+	tokOp
+)
+
+type filterToken struct {
+	kind filterTokenKind
+	text string
+	pos  int
+}
+
+// Operators, longest first so "<=" wins over "<"
+var filterOperators = []string{"&&", "||", "==", "!=", "!~", "<=", ">=", "<", ">", "~", "=", "!", "(", ")", ","}
+
+func tokenizeFilter(expr string) ([]filterToken, error) {
+	var tokens []filterToken
+	i := 0
+	for i < len(expr) {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+			continue
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(expr[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string at position %d", i)
+			}
+			tokens = append(tokens, filterToken{tokString, expr[i+1 : i+1+end], i})
+			i += end + 2
+			continue
+		}
+
+		matched := false
+		for _, op := range filterOperators {
+			if strings.HasPrefix(expr[i:], op) {
+				tokens = append(tokens, filterToken{tokOp, op, i})
+				if op == "=" {
+					tokens[len(tokens)-1].text = "=="
+				}
+				i += len(op)
+				matched = true
+				break
+			}
+		}
+		if matched {
+			continue
+		}
+
+		start := i
+		for i < len(expr) && !strings.ContainsRune(" \t\n\"'()!=<>~&|,", rune(expr[i])) {
+			i++
+		}
+		if start == i {
+			return nil, fmt.Errorf("unexpected %q at position %d", expr[i], i)
+		}
+		tokens = append(tokens, filterToken{tokWord, expr[start:i], start})
+	}
+	return append(tokens, filterToken{tokEOF, "end of expression", len(expr)}), nil
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+	fields map[string]bool
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() filterToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *filterParser) isOp(text string) bool {
+	tok := p.peek()
+	return tok.kind == tokOp && tok.text == text
+}
+
+func (p *filterParser) parseOr() (Filter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("||") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orFilter{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (Filter, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("&&") {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andFilter{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (Filter, error) {
+	switch {
+	case p.isOp("!"):
+		p.next()
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notFilter{inner}, nil
+	case p.isOp("("):
+		p.next()
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.isOp(")") {
+			tok := p.peek()
+			return nil, fmt.Errorf("expected ) at position %d, found %q", tok.pos, tok.text)
+		}
+		p.next()
+		return inner, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *filterParser) parseComparison() (Filter, error) {
+	fieldTok := p.next()
+	if fieldTok.kind != tokWord {
+		return nil, fmt.Errorf("expected a field name at position %d, found %q", fieldTok.pos, fieldTok.text)
+	}
+	if !p.fields[fieldTok.text] {
+		return nil, fmt.Errorf("unknown field %q at position %d", fieldTok.text, fieldTok.pos)
+	}
+	f := &compareFilter{field: fieldTok.text}
+
+	opTok := p.next()
+	switch {
+	case opTok.kind == tokWord && opTok.text == "in":
+		f.op = "in"
+		return f, p.parseSet(f)
+	case opTok.kind == tokOp && isComparison(opTok.text):
+		f.op = opTok.text
+	default:
+		return nil, fmt.Errorf("expected an operator after %q at position %d, found %q", f.field, opTok.pos, opTok.text)
+	}
+
+	valueTok := p.next()
+	if valueTok.kind != tokWord && valueTok.kind != tokString {
+		return nil, fmt.Errorf("expected a value after %q at position %d, found %q", opTok.text, valueTok.pos, valueTok.text)
+	}
+	f.value = valueTok.text
+
+	switch {
+	case f.op == "~" || f.op == "!~":
+		pattern, err := regexp.Compile(f.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex for %s: %w", f.field, err)
+		}
+		f.pattern = pattern
+	case f.field == "time":
+		when, err := parseFlexibleTime(f.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time for %s: %w", f.field, err)
+		}
+		f.when = when
+	case f.field == "duration":
+		// Durations compare in milliseconds; "250ms" or "1.5s" also work
+		if d, err := time.ParseDuration(f.value); err == nil {
+			f.number, f.isNumber = float64(d)/float64(time.Millisecond), true
+			break
+		}
+		fallthrough
+	default:
+		if n, err := strconv.ParseFloat(f.value, 64); err == nil {
+			f.number, f.isNumber = n, true
+		}
+	}
+	return f, nil
+}
+
+func isComparison(op string) bool {
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=", "~", "!~":
+		return true
+	}
+	return false
+}
+
+// parseSet reads the right-hand side of "in": a single value or a
+// parenthesised list; items containing "/" are CIDR ranges
+func (p *filterParser) parseSet(f *compareFilter) error {
+	var items []filterToken
+	if p.isOp("(") {
+		p.next()
+		for {
+			tok := p.next()
+			if tok.kind != tokWord && tok.kind != tokString {
+				return fmt.Errorf("expected a list item at position %d, found %q", tok.pos, tok.text)
+			}
+			items = append(items, tok)
+			if p.isOp(",") {
+				p.next()
+				continue
+			}
+			if !p.isOp(")") {
+				tok := p.peek()
+				return fmt.Errorf("expected , or ) at position %d, found %q", tok.pos, tok.text)
+			}
+			p.next()
+			break
+		}
+	} else {
+		tok := p.next()
+		if tok.kind != tokWord && tok.kind != tokString {
+			return fmt.Errorf("expected a value after \"in\" at position %d, found %q", tok.pos, tok.text)
+		}
+		items = append(items, tok)
+	}
+
+	for _, item := range items {
+		if strings.Contains(item.text, "/") && item.kind == tokWord {
+			_, network, err := net.ParseCIDR(item.text)
+			if err != nil {
+				return fmt.Errorf("invalid CIDR at position %d: %w", item.pos, err)
+			}
+			f.nets = append(f.nets, network)
+			continue
+		}
+		f.list = append(f.list, item.text)
+	}
+	return nil
+}
+
+func (la *LogAnalyzer) updateStats(entry *LogEntry, stats *Stats) {
+	// Status codes (syslog messages that are not requests have none)
+	if entry.Status != 0 {
+		stats.StatusCodes[entry.Status]++
+	}
+
+	// Top IPs
+	if entry.IP != "" {
+		if a := stats.Approx; a != nil {
+			a.IPs.Add(entry.IP, 1)
+			a.UniqueIPs.Add(entry.IP)
+		} else {
+			stats.TopIPs[entry.IP]++
+		}
+	}
+
+	// Top pages (ignore query parameters for grouping)
+	url := stripQuery(entry.URL)
+	if url != "" {
+		if a := stats.Approx; a != nil {
+			// Per-page latency is only kept for pages still being tracked
+			if evicted, ok := a.Pages.Add(url, 1); ok {
+				delete(stats.LatencyByPage, evicted)
+			}
+			a.UniquePages.Add(url)
+		} else {
+			stats.TopPages[url]++
+		}
+	}
+
+	// Requests per input file
+	stats.RequestsPerFile[entry.Source]++
+
+	// Origins from -ipdb
+	if la.Enricher != nil {
+		if entry.Country != "" {
+			stats.TopCountries[entry.Country]++
+		}
+		if network := networkName(entry); network != "" {
+			stats.TopNetworks[network]++
+		}
+		if entry.Label != "" {
+			stats.TopLabels[entry.Label]++
+		}
+	}
+
+	// Custom groupings
+	if stats.Groups != nil {
+		stats.Groups.Add(entry)
+	}
+
+	// Counts for -rules
+	if stats.Alerts != nil {
+		stats.Alerts.Add(entry)
+	}
+
+	// Response times overall, per page and per status class
+	if entry.Timed {
+		if stats.Latency == nil {
+			stats.Latency = NewLatencySketch()
+		}
+		stats.Latency.Add(entry.Duration)
+		if url != "" {
+			addLatency(stats.LatencyByPage, url, entry.Duration)
+		}
+		if entry.Status != 0 {
+			addLatency(stats.LatencyByStatus, statusClass(entry.Status), entry.Duration)
+		}
+	}
+
+	// User agents
+	if entry.UserAgent != "" {
+		if a := stats.Approx; a != nil {
+			a.UserAgents.Add(entry.UserAgent, 1)
+		} else {
+			stats.TopUserAgents[entry.UserAgent]++
+		}
+	}
+
+	// Requests per hour
+	hourKey := entry.Timestamp.Format("2006-01-02 15:00")
+	stats.RequestsPerHour[hourKey]++
+
+	// Requests per day
+	dayKey := entry.Timestamp.Format("2006-01-02")
+	stats.RequestsPerDay[dayKey]++
+
+	// Series used by anomaly detection
+	stats.BytesPerHour[hourKey] += entry.Size
+	stats.BytesPerDay[dayKey] += entry.Size
+	if entry.Status >= 400 {
+		stats.ErrorsPerHour[hourKey]++
+		stats.ErrorsPerDay[dayKey]++
+	}
+	if entry.IP != "" {
+		if a := stats.Approx; a != nil {
+			ips, ok := a.IPsPerHour[hourKey]
+			if !ok {
+				ips = NewSpaceSaving(hourlyIPCounters)
+				a.IPsPerHour[hourKey] = ips
+			}
+			ips.Add(entry.IP, 1)
+		} else {
+			ips, ok := stats.IPsPerHour[hourKey]
+			if !ok {
+				ips = make(map[string]int)
+				stats.IPsPerHour[hourKey] = ips
+			}
+			ips[entry.IP]++
+		}
+	}
+}
+
+// Quantiles reported for every latency sketch
+var latencyQuantiles = []float64{0.5, 0.9, 0.95, 0.99}
+
+// Upper bounds of the fixed histogram buckets, as used by Prometheus
+var latencyBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// Relative accuracy of sketch quantiles: each bin spans a 2% ratio, so a
+// quantile is within about 1% of the true value
+const sketchGamma = 1.02
+
+// LatencySketch estimates quantiles with logarithmic bins (in the style of
+// DDSketch), so memory depends on the range of durations rather than the
+// number of requests. It also counts the fixed histogram buckets.
+type LatencySketch struct {
+	Count   int
+	Sum     time.Duration
+	Min     time.Duration
+	Max     time.Duration
+	bins    map[int]int
+	buckets []int
+}
+
+func NewLatencySketch() *LatencySketch {
+	return &LatencySketch{
+		bins:    make(map[int]int),
+		buckets: make([]int, len(latencyBuckets)+1),
+	}
+}
+
+func (s *LatencySketch) Add(d time.Duration) {
+	if s.Count == 0 || d < s.Min {
+		s.Min = d
+	}
+	if d > s.Max {
+		s.Max = d
+	}
+	s.Count++
+	s.Sum += d
+	s.bins[sketchBin(d)]++
+	s.buckets[sort.Search(len(latencyBuckets), func(i int) bool { return d <= latencyBuckets[i] })]++
+}
+
+// Merge folds another sketch into s
+func (s *LatencySketch) Merge(other *LatencySketch) {
+	if other == nil || other.Count == 0 {
+		return
+	}
+	if s.Count == 0 || other.Min < s.Min {
+		s.Min = other.Min
+	}
+	if other.Max > s.Max {
+		s.Max = other.Max
+	}
+	s.Count += other.Count
+	s.Sum += other.Sum
+	for bin, n := range other.bins {
+		s.bins[bin] += n
+	}
+	for i, n := range other.buckets {
+		s.buckets[i] += n
+	}
+}
+
+// sketchBin maps a duration to its logarithmic bin; everything up to a
+// microsecond shares bin 0
+func sketchBin(d time.Duration) int {
+	us := float64(d) / float64(time.Microsecond)
+	if us <= 1 {
+		return 0
+	}
+	return int(math.Ceil(math.Log(us) / math.Log(sketchGamma)))
+}
+
+func (s *LatencySketch) Quantile(q float64) time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+
+	bins := make([]int, 0, len(s.bins))
+	for bin := range s.bins {
+		bins = append(bins, bin)
+	}
+	sort.Ints(bins)
+
+	rank := int(q * float64(s.Count-1))
+	seen := 0
+	for _, bin := range bins {
+		seen += s.bins[bin]
+		if seen > rank {
+			// Bin midpoint, clamped to the exact extremes
+			us := 2 * math.Pow(sketchGamma, float64(bin)) / (sketchGamma + 1)
+			d := time.Duration(us * float64(time.Microsecond))
+			if d < s.Min {
+				d = s.Min
+			}
+			if d > s.Max {
+				d = s.Max
+			}
+			return d
+		}
+	}
+	return s.Max
+}
+
+func (s *LatencySketch) Mean() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Sum / time.Duration(s.Count)
+}
+
+// LatencyBucket is one histogram bucket; an empty LE is the +Inf bucket
+type LatencyBucket struct {
+	LE    string `json:"le"`
+	Count int    `json:"count"`
+}
+
+// Buckets returns the non-cumulative histogram counts
+func (s *LatencySketch) Buckets() []LatencyBucket {
+	result := make([]LatencyBucket, len(s.buckets))
+	for i, n := range s.buckets {
+		le := "+Inf"
+		if i < len(latencyBuckets) {
+			le = latencyBuckets[i].String()
+		}
+		result[i] = LatencyBucket{LE: le, Count: n}
+	}
+	return result
+}
+
+func (s *LatencySketch) MarshalJSON() ([]byte, error) {
+	summary := map[string]interface{}{
+		"count":   s.Count,
+		"mean_ms": durationMillis(s.Mean()),
+		"max_ms":  durationMillis(s.Max),
+		"buckets": s.Buckets(),
+	}
+	for _, q := range latencyQuantiles {
+		summary[fmt.Sprintf("p%g_ms", q*100)] = durationMillis(s.Quantile(q))
+	}
+	return json.Marshal(summary)
+}
+
+func addLatency(m map[string]*LatencySketch, key string, d time.Duration) {
+	sketch, ok := m[key]
+	if !ok {
+		sketch = NewLatencySketch()
+		m[key] = sketch
+	}
+	sketch.Add(d)
+}
+
+// statusClass groups a status code as "2xx", "4xx", ...
+func statusClass(status int) string {
+	return fmt.Sprintf("%dxx", status/100)
+}
+
+func durationMillis(d time.Duration) float64 {
+	return math.Round(float64(d)/float64(time.Microsecond)) / 1000
+}
+
+func formatMillis(d time.Duration) string {
+	return strconv.FormatFloat(durationMillis(d), 'f', -1, 64)
+}
+
+// printLatencySection prints percentiles overall, per status class and
+// for the busiest pages, followed by an ASCII histogram
+func printLatencySection(stats *Stats, topCount int) {
+	header := fmt.Sprintf("  %-30s %8s %10s %10s %10s %10s %10s", "", "Count", "p50", "p90", "p95", "p99", "Max")
+	row := func(label string, s *LatencySketch) {
+		if len(label) > 30 {
+			label = label[:27] + "..."
+		}
+		fmt.Printf("  %-30s %8d %10s %10s %10s %10s %10s\n", label, s.Count,
+			formatLatency(s.Quantile(0.5)), formatLatency(s.Quantile(0.9)),
+			formatLatency(s.Quantile(0.95)), formatLatency(s.Quantile(0.99)),
+			formatLatency(s.Max))
+	}
+
+	fmt.Printf("Response Times:\n")
+	fmt.Println(header)
+	row("All requests", stats.Latency)
+	for _, class := range getSortedSketchKeys(stats.LatencyByStatus) {
+		row(class, stats.LatencyByStatus[class])
+	}
+	fmt.Printf("\n")
+
+	fmt.Printf("Response Times by Page:\n")
+	fmt.Println(header)
+	for _, item := range getSortedMapByValue(stats.TopPages, topCount) {
+		if sketch, ok := stats.LatencyByPage[item.Key]; ok {
+			row(item.Key, sketch)
+		}
+	}
+	fmt.Printf("\n")
+
+	fmt.Printf("Latency Histogram:\n")
+	buckets := stats.Latency.Buckets()
+	largest := 0
+	for _, b := range buckets {
+		if b.Count > largest {
+			largest = b.Count
+		}
+	}
+	for _, b := range buckets {
+		width := 0
+		if largest > 0 {
+			width = b.Count * 40 / largest
+		}
+		if width == 0 && b.Count > 0 {
+			width = 1
+		}
+		fmt.Printf("  <= %-6s %-40s %d\n", b.LE, strings.Repeat("#", width), b.Count)
+	}
+	fmt.Printf("\n")
+}
+
+// formatLatency prints a duration rounded for display
+func formatLatency(d time.Duration) string {
+	switch {
+	case d >= time.Second:
+		return fmt.Sprintf("%.2fs", d.Seconds())
+	case d >= time.Millisecond:
+		return fmt.Sprintf("%.1fms", float64(d)/float64(time.Millisecond))
+	default:
+		return fmt.Sprintf("%dµs", d/time.Microsecond)
+	}
+}
+
+func getSortedSketchKeys(m map[string]*LatencySketch) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Anomaly detection settings
+const (
+	// Counters per hour for spotting a dominant IP in -approx mode
+	hourlyIPCounters = 64
+	// Rolling baseline lengths and the minimum history before flagging
+	hourlyBaseline = 24
+	dailyBaseline  = 7
+	minBaseline    = 6
+	// Robust z-score above which a bucket is anomalous
+	anomalyThreshold = 3.5
+	// Buckets with fewer requests are not judged on error rate
+	minRateRequests = 20
+	// An IP dominates an hour above this share, if it is at most half as
+	// prominent over the whole log
+	dominanceShare       = 0.3
+	minDominanceRequests = 100
+)
+
+// Anomaly is a time bucket that deviates from its rolling baseline
+type Anomaly struct {
+	Window      string
+	Start       time.Time
+	End         time.Time
+	Metric      string
+	Value       float64
+	Baseline    float64
+	Score       float64
+	Description string
+}
+
+// detectAnomalies compares every hour and day with the median and MAD of
+// the buckets before it, and looks for IPs dominating an hour
+func detectAnomalies(stats *Stats) []Anomaly {
+	var anomalies []Anomaly
+	series := []struct {
+		layout   string
+		step     func(time.Time) time.Time
+		baseline int
+		requests map[string]int
+		errors   map[string]int
+		bytes    map[string]int64
+	}{
+		{"2006-01-02 15:00", func(t time.Time) time.Time { return t.Add(time.Hour) }, hourlyBaseline,
+			stats.RequestsPerHour, stats.ErrorsPerHour, stats.BytesPerHour},
+		{"2006-01-02", func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }, dailyBaseline,
+			stats.RequestsPerDay, stats.ErrorsPerDay, stats.BytesPerDay},
+	}
+
+	for _, sr := range series {
+		keys := getSortedKeys(sr.requests)
+		if len(keys) == 0 {
+			continue
+		}
+		first, err1 := time.Parse(sr.layout, keys[0])
+		last, err2 := time.Parse(sr.layout, keys[len(keys)-1])
+		if err1 != nil || err2 != nil {
+			continue
+		}
+
+		// Walk every bucket, including silent ones, so outages show up
+		var volumes, rates, sizes []float64
+		var rateBuckets []bool
+		var starts []time.Time
+		for t := first; !t.After(last); t = sr.step(t) {
+			key := t.Format(sr.layout)
+			requests := sr.requests[key]
+			volumes = append(volumes, float64(requests))
+			sizes = append(sizes, float64(sr.bytes[key]))
+			rate := 0.0
+			if requests > 0 {
+				rate = float64(sr.errors[key]) / float64(requests)
+			}
+			rates = append(rates, rate)
+			rateBuckets = append(rateBuckets, requests >= minRateRequests)
+			starts = append(starts, t)
+		}
+
+		for i := range starts {
+			window := fmt.Sprintf("%s – %s", starts[i].Format("2006-01-02 15:04"), sr.step(starts[i]).Format("2006-01-02 15:04"))
+			from := i - sr.baseline
+			if from < 0 {
+				from = 0
+			}
+
+			check := func(metric string, values []float64, usable []bool, format func(float64) string) {
+				var history []float64
+				for j := from; j < i; j++ {
+					if usable == nil || usable[j] {
+						history = append(history, values[j])
+					}
+				}
+				if len(history) < minBaseline || (usable != nil && !usable[i]) {
+					return
+				}
+				median, score, flat := robustScore(values[i], history)
+				if math.Abs(score) < anomalyThreshold {
+					return
+				}
+				direction := "spike"
+				if score < 0 {
+					direction = "drop"
+				}
+				anomaly := Anomaly{
+					Window:   window,
+					Start:    starts[i],
+					End:      sr.step(starts[i]),
+					Metric:   metric,
+					Value:    values[i],
+					Baseline: median,
+					Score:    math.Round(score*10) / 10,
+				}
+				anomaly.Description = fmt.Sprintf("%s %s: %s vs baseline %s (score %.1f)",
+					metric, direction, format(values[i]), format(median), score)
+				if flat {
+					anomaly.Description = fmt.Sprintf("%s %s: %s vs constant %s",
+						metric, direction, format(values[i]), format(median))
+				}
+				anomalies = append(anomalies, anomaly)
+			}
+
+			count := func(v float64) string { return strconv.Itoa(int(v)) }
+			percent := func(v float64) string { return fmt.Sprintf("%.1f%%", v*100) }
+			size := func(v float64) string { return formatBytes(int64(v)) }
+			check("requests", volumes, nil, count)
+			check("error rate", rates, rateBuckets, percent)
+			check("bytes", sizes, nil, size)
+		}
+	}
+
+	// Single IPs taking over an hour of traffic. In -approx mode the counts
+	// come from a sketch and may be overstated, so they are marked with ~.
+	for _, hour := range getSortedKeys(stats.RequestsPerHour) {
+		total := stats.RequestsPerHour[hour]
+		ips, ok := stats.IPsPerHour[hour]
+		mark := ""
+		if a := stats.Approx; a != nil {
+			var sketch *SpaceSaving
+			sketch, ok = a.IPsPerHour[hour]
+			if ok {
+				ips = sketch.Counts()
+			}
+			mark = "~"
+		}
+		if !ok || total < minDominanceRequests {
+			continue
+		}
+		for _, item := range getSortedMapByValue(ips, 1) {
+			share := float64(item.Value) / float64(total)
+			overall := float64(stats.TopIPs[item.Key]) / float64(stats.TotalRequests)
+			if share < dominanceShare || overall > share/2 {
+				continue
+			}
+			start, err := time.Parse("2006-01-02 15:00", hour)
+			if err != nil {
+				continue
+			}
+			anomalies = append(anomalies, Anomaly{
+				Window:   fmt.Sprintf("%s – %s", start.Format("2006-01-02 15:04"), start.Add(time.Hour).Format("2006-01-02 15:04")),
+				Start:    start,
+				End:      start.Add(time.Hour),
+				Metric:   "ip share",
+				Value:    share,
+				Baseline: overall,
+				Description: fmt.Sprintf("IP %s sent %s%.0f%% of requests (%s%d of %d) vs %.1f%% overall",
+					item.Key, mark, share*100, mark, item.Value, total, overall*100),
+			})
+		}
+	}
+
+	sort.SliceStable(anomalies, func(i, j int) bool {
+		return anomalies[i].Start.Before(anomalies[j].Start)
+	})
+	return anomalies
+}
+
+// robustScore returns the baseline median and the modified z-score of x,
+// using the median absolute deviation so earlier spikes don't skew it.
+// flat reports a constant baseline, where the score is only a sign.
+func robustScore(x float64, history []float64) (median, score float64, flat bool) {
+	median = medianOf(history)
+	deviations := make([]float64, len(history))
+	for i, v := range history {
+		deviations[i] = math.Abs(v - median)
+	}
+	mad := medianOf(deviations)
+
+	if mad > 0 {
+		return median, (x - median) / (1.4826 * mad), false
+	}
+
+	// Fall back to the mean absolute deviation
+	mean := 0.0
+	for _, d := range deviations {
+		mean += d
+	}
+	mean /= float64(len(deviations))
+	if mean > 0 {
+		return median, (x - median) / (1.2533 * mean), false
+	}
+
+	// A perfectly flat baseline: flag changes of more than half
+	if math.Abs(x-median) <= 0.5*math.Abs(median) || x == median {
+		return median, 0, true
+	}
+	return median, math.Copysign(anomalyThreshold, x-median), true
+}
+
+func medianOf(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// Exit status when a -rules alert fires, distinct from the usual 1 for
+// failures
+const alertExitCode = 3
+
+// Metrics a rule can test. Per-window rules and rules with a where
+// condition are limited to the counted ones; the rest apply to the run.
+var (
+	windowedMetrics = []string{"requests", "errors", "error_rate", "bytes", "p50_ms", "p90_ms", "p95_ms", "p99_ms"}
+	runMetrics      = []string{"unique_ips", "unique_pages", "parse_errors"}
+)
+
+// AlertRule is one condition from a -rules file, for example
+//
+//	{"name": "checkout load", "metric": "requests", "where": "path == /checkout",
+//	 "per": "1h", "op": ">", "threshold": 100}
+type AlertRule struct {
+	Name        string  `json:"name"`
+	Metric      string  `json:"metric"`
+	Op          string  `json:"op"`
+	Threshold   float64 `json:"threshold"`
+	Per         string  `json:"per,omitempty"`
+	Where       string  `json:"where,omitempty"`
+	MinRequests int     `json:"min_requests,omitempty"`
+
+	window time.Duration
+	filter Filter
+}
+
+// LoadAlertRules reads and validates a rules file of the form
+// {"rules": [...]}
+func LoadAlertRules(path string, fields []string) ([]*AlertRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules: %w", err)
+	}
+
+	var file struct {
+		Rules []*AlertRule `json:"rules"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if len(file.Rules) == 0 {
+		return nil, fmt.Errorf("%s defines no rules", path)
+	}
+
+	for i, rule := range file.Rules {
+		if err := rule.compile(fields); err != nil {
+			return nil, fmt.Errorf("rule %d (%s): %w", i+1, rule.Name, err)
+		}
+	}
+	return file.Rules, nil
+}
+
+func (r *AlertRule) compile(fields []string) error {
+	if r.Name == "" {
+		r.Name = fmt.Sprintf("%s %s %s", r.Metric, r.Op, strconv.FormatFloat(r.Threshold, 'f', -1, 64))
+		if r.Per != "" {
+			r.Name += " per " + r.Per
+		}
+	}
+
+	switch r.Op {
+	case ">", ">=", "<", "<=", "==", "!=":
+	default:
+		return fmt.Errorf("unknown op %q (use > >= < <= == !=)", r.Op)
+	}
+
+	if r.Per != "" {
+		window, err := time.ParseDuration(r.Per)
+		if err != nil || window < time.Second {
+			return fmt.Errorf("invalid per %q (use a duration such as 1h)", r.Per)
+		}
+		r.window = window
+	}
+	if r.Where != "" {
+		filter, err := ParseFilter(r.Where, fields)
+		if err != nil {
+			return fmt.Errorf("invalid where: %w", err)
+		}
+		r.filter = filter
+	}
+
+	switch {
+	case contains(windowedMetrics, r.Metric):
+	case contains(runMetrics, r.Metric):
+		if r.window > 0 || r.filter != nil {
+			return fmt.Errorf("metric %s cannot be combined with per or where", r.Metric)
+		}
+	default:
+		return fmt.Errorf("unknown metric %q (use %s or %s)", r.Metric,
+			strings.Join(windowedMetrics, ", "), strings.Join(runMetrics, ", "))
+	}
+	return nil
+}
+
+// violated reports whether value breaks the rule
+func (r *AlertRule) violated(value float64) bool {
+	switch r.Op {
+	case ">":
+		return value > r.Threshold
+	case ">=":
+		return value >= r.Threshold
+	case "<":
+		return value < r.Threshold
+	case "<=":
+		return value <= r.Threshold
+	case "==":
+		return value == r.Threshold
+	}
+	return value != r.Threshold
+}
+
+// alertCounts are the totals of one rule window
+type alertCounts struct {
+	Requests int
+	Errors   int
+	Bytes    int64
+	Latency  *LatencySketch
+}
+
+func (c *alertCounts) metric(name string) float64 {
+	switch name {
+	case "requests":
+		return float64(c.Requests)
+	case "errors":
+		return float64(c.Errors)
+	case "error_rate":
+		if c.Requests == 0 {
+			return 0
+		}
+		return float64(c.Errors) / float64(c.Requests) * 100
+	case "bytes":
+		return float64(c.Bytes)
+	}
+	if c.Latency == nil {
+		return 0
+	}
+	q, _ := strconv.ParseFloat(strings.TrimSuffix(strings.TrimPrefix(name, "p"), "_ms"), 64)
+	return durationMillis(c.Latency.Quantile(q / 100))
+}
+
+// AlertTracker counts the entries matching each rule, per window. The run
+// as a whole is window 0.
+type AlertTracker struct {
+	Rules   []*AlertRule
+	windows []map[int64]*alertCounts
+	first   time.Time
+	last    time.Time
+}
+
+func NewAlertTracker(rules []*AlertRule) *AlertTracker {
+	t := &AlertTracker{Rules: rules}
+	for range rules {
+		t.windows = append(t.windows, make(map[int64]*alertCounts))
+	}
+	return t
+}
+
+func (t *AlertTracker) Add(entry *LogEntry) {
+	t.extend(entry.Timestamp, entry.Timestamp)
+	for i, rule := range t.Rules {
+		if contains(runMetrics, rule.Metric) {
+			continue
+		}
+		if rule.filter != nil && !rule.filter.Match(entry) {
+			continue
+		}
+
+		var start int64
+		if rule.window > 0 {
+			start = entry.Timestamp.Truncate(rule.window).Unix()
+		}
+		counts, ok := t.windows[i][start]
+		if !ok {
+			counts = &alertCounts{}
+			t.windows[i][start] = counts
+		}
+		counts.Requests++
+		counts.Bytes += entry.Size
+		if entry.Status >= 400 {
+			counts.Errors++
+		}
+		if entry.Timed && strings.HasSuffix(rule.Metric, "_ms") {
+			if counts.Latency == nil {
+				counts.Latency = NewLatencySketch()
+			}
+			counts.Latency.Add(entry.Duration)
+		}
+	}
+}
+
+// extend widens the time span covered by the run
+func (t *AlertTracker) extend(first, last time.Time) {
+	if first.IsZero() {
+		return
+	}
+	if t.first.IsZero() || first.Before(t.first) {
+		t.first = first
+	}
+	if last.After(t.last) {
+		t.last = last
+	}
+}
+
+func (t *AlertTracker) Merge(other *AlertTracker) {
+	t.extend(other.first, other.last)
+	for i := range t.Rules {
+		for start, theirs := range other.windows[i] {
+			mine, ok := t.windows[i][start]
+			if !ok {
+				mine = &alertCounts{}
+				t.windows[i][start] = mine
+			}
+			mine.Requests += theirs.Requests
+			mine.Errors += theirs.Errors
+			mine.Bytes += theirs.Bytes
+			if theirs.Latency != nil {
+				if mine.Latency == nil {
+					mine.Latency = NewLatencySketch()
+				}
+				mine.Latency.Merge(theirs.Latency)
+			}
+		}
+	}
+}
+
+// Violation is a rule broken by the run or by one of its windows
+type Violation struct {
+	Rule        string
+	Window      string
+	Start       time.Time
+	End         time.Time
+	Metric      string
+	Value       float64
+	Threshold   float64
+	Op          string
+	Description string
+}
+
+// Evaluate checks every rule against its windows in time order. Windows
+// with no matching entries count as zero, so minimums catch gaps.
+func (t *AlertTracker) Evaluate(stats *Stats) []Violation {
+	var violations []Violation
+	for i, rule := range t.Rules {
+		check := func(window string, start, end time.Time, value float64) {
+			if rule.violated(value) {
+				violations = append(violations, Violation{
+					Rule: rule.Name, Window: window, Start: start, End: end,
+					Metric: rule.Metric, Value: value, Threshold: rule.Threshold, Op: rule.Op,
+					Description: fmt.Sprintf("%s: %s is %s (%s %s)", rule.Name, rule.Metric,
+						formatAlertValue(rule.Metric, value), rule.Op, formatAlertValue(rule.Metric, rule.Threshold)),
+				})
+			}
+		}
+
+		switch {
+		case rule.Metric == "unique_ips":
+			check("all", time.Time{}, time.Time{}, float64(stats.UniqueIPs))
+		case rule.Metric == "unique_pages":
+			check("all", time.Time{}, time.Time{}, float64(stats.UniquePages))
+		case rule.Metric == "parse_errors":
+			check("all", time.Time{}, time.Time{}, float64(stats.ParseErrors))
+		case rule.window == 0:
+			counts := t.windows[i][0]
+			if counts == nil {
+				counts = &alertCounts{}
+			}
+			if counts.Requests >= rule.MinRequests {
+				check("all", time.Time{}, time.Time{}, counts.metric(rule.Metric))
+			}
+		default:
+			// Windows span the whole run, not only those this rule matched
+			if t.first.IsZero() {
+				continue
+			}
+			step := int64(rule.window / time.Second)
+			if step == 0 {
+				step = 1
+			}
+			from := t.first.Truncate(rule.window).Unix()
+			for start := from; start <= t.last.Unix(); start += step {
+				counts := t.windows[i][start]
+				if counts == nil {
+					counts = &alertCounts{}
+				}
+				if counts.Requests < rule.MinRequests {
+					continue
+				}
+				begin := time.Unix(start, 0).In(t.first.Location())
+				end := begin.Add(rule.window)
+				window := fmt.Sprintf("%s – %s", begin.Format("2006-01-02 15:04"), end.Format("2006-01-02 15:04"))
+				check(window, begin, end, counts.metric(rule.Metric))
+			}
+		}
+	}
+	return violations
+}
+
+// formatAlertValue prints a metric value in its natural unit
+func formatAlertValue(metric string, value float64) string {
+	switch {
+	case metric == "error_rate":
+		return fmt.Sprintf("%.2f%%", value)
+	case metric == "bytes":
+		return formatBytes(int64(value))
+	case strings.HasSuffix(metric, "_ms"):
+		return fmt.Sprintf("%.1fms", value)
+	}
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// A status code shifted significantly when its share of requests moved by
+// at least this many percentage points
+const statusShiftPoints = 1.0
+
+// Comparison is the difference between a baseline run and a later one
+type Comparison struct {
+	Before        string
+	After         string
+	Metrics       []MetricDelta
+	StatusShifts  []StatusShift
+	PageChanges   []CountDelta
+	NewPages      []CountDelta
+	VanishedPages []CountDelta
+	IPChanges     []CountDelta
+	NewIPs        []CountDelta
+	VanishedIPs   []CountDelta
+}
+
+// MetricDelta is one summary figure on both sides. Percent is the relative
+// change, absent when the baseline is zero.
+type MetricDelta struct {
+	Name    string
+	Unit    string
+	Before  float64
+	After   float64
+	Change  float64
+	Percent *float64 `json:",omitempty"`
+}
+
+// StatusShift compares a status code's share of all requests
+type StatusShift struct {
+	Status      int
+	Before      int
+	After       int
+	BeforeShare float64
+	AfterShare  float64
+	Points      float64
+}
+
+// CountDelta compares a page's or IP's request count
+type CountDelta struct {
+	Key     string
+	Before  int
+	After   int
+	Change  int
+	Percent *float64 `json:",omitempty"`
+}
+
+// Compare analyzes two inputs, or the same input before and after split,
+// and reports the changes from the first to the second
+func (la *LogAnalyzer) Compare(sides [][]string, split time.Time) (*Comparison, error) {
+	before, after := *la, *la
+	labels := make([]string, 2)
+
+	if sides == nil {
+		// Each side reads the inputs again, which stdin does not allow
+		if contains(la.Files, "-") {
+			return nil, fmt.Errorf("compare cannot read stdin")
+		}
+		if la.EndTime.IsZero() || la.EndTime.After(split) {
+			before.EndTime = split.Add(-time.Nanosecond)
+		}
+		if la.StartTime.Before(split) {
+			after.StartTime = split
+		}
+		labels[0] = "before " + split.Format(time.RFC3339)
+		labels[1] = "from " + split.Format(time.RFC3339)
+	} else {
+		for i, side := range []*LogAnalyzer{&before, &after} {
+			files, err := expandInputs(sides[i])
+			if err != nil {
+				return nil, fmt.Errorf("invalid input: %w", err)
+			}
+			if contains(files, "-") {
+				return nil, fmt.Errorf("compare cannot read stdin")
+			}
+			side.Files = files
+			labels[i] = strings.Join(files, ", ")
+		}
+	}
+
+	beforeStats, err := before.Analyze()
+	if err != nil {
+		return nil, fmt.Errorf("failed to analyze %s: %w", labels[0], err)
+	}
+	afterStats, err := after.Analyze()
+	if err != nil {
+		return nil, fmt.Errorf("failed to analyze %s: %w", labels[1], err)
+	}
+	return Compare(labels[0], labels[1], beforeStats, afterStats, la.TopCount), nil
+}
+
+// relativeChange returns the change from before to after in percent
+func relativeChange(before, after float64) *float64 {
+	if before == 0 {
+		return nil
+	}
+	percent := (after - before) / before * 100
+	return &percent
+}
+
+// Compare builds the comparison of two runs, considering the top pages and
+// IPs of either side
+func Compare(beforeLabel, afterLabel string, before, after *Stats, top int) *Comparison {
+	c := &Comparison{Before: beforeLabel, After: afterLabel}
+
+	metric := func(name, unit string, b, a float64) {
+		c.Metrics = append(c.Metrics, MetricDelta{
+			Name: name, Unit: unit, Before: b, After: a, Change: a - b,
+			Percent: relativeChange(b, a),
+		})
+	}
+	metric("requests", "count", float64(before.TotalRequests), float64(after.TotalRequests))
+	metric("requests_per_hour", "count", requestsPerActiveHour(before), requestsPerActiveHour(after))
+	metric("bytes", "bytes", float64(before.TotalBytes), float64(after.TotalBytes))
+	metric("error_rate", "percent", errorRate(before), errorRate(after))
+	metric("unique_ips", "count", float64(before.UniqueIPs), float64(after.UniqueIPs))
+	metric("unique_pages", "count", float64(before.UniquePages), float64(after.UniquePages))
+	if before.Latency != nil || after.Latency != nil {
+		b, a := before.Latency, after.Latency
+		if b == nil {
+			b = NewLatencySketch()
+		}
+		if a == nil {
+			a = NewLatencySketch()
+		}
+		metric("latency_mean", "ms", durationMillis(b.Mean()), durationMillis(a.Mean()))
+		for _, q := range latencyQuantiles {
+			name := fmt.Sprintf("latency_p%g", q*100)
+			metric(name, "ms", durationMillis(b.Quantile(q)), durationMillis(a.Quantile(q)))
+		}
+	}
+
+	// Status codes are compared by share, since the volumes may differ
+	for code := range mergeKeys(before.StatusCodes, after.StatusCodes) {
+		shift := StatusShift{
+			Status:      code,
+			Before:      before.StatusCodes[code],
+			After:       after.StatusCodes[code],
+			BeforeShare: share(before.StatusCodes[code], before.TotalRequests),
+			AfterShare:  share(after.StatusCodes[code], after.TotalRequests),
+		}
+		shift.Points = shift.AfterShare - shift.BeforeShare
+		if math.Abs(shift.Points) >= statusShiftPoints {
+			c.StatusShifts = append(c.StatusShifts, shift)
+		}
+	}
+	sort.Slice(c.StatusShifts, func(i, j int) bool {
+		a, b := math.Abs(c.StatusShifts[i].Points), math.Abs(c.StatusShifts[j].Points)
+		if a != b {
+			return a > b
+		}
+		return c.StatusShifts[i].Status < c.StatusShifts[j].Status
+	})
+
+	c.PageChanges, c.NewPages, c.VanishedPages = compareCounts(before.TopPages, after.TopPages, top)
+	c.IPChanges, c.NewIPs, c.VanishedIPs = compareCounts(before.TopIPs, after.TopIPs, top)
+	return c
+}
+
+// compareCounts splits the union of both top lists into keys seen on both
+// sides, keys only after and keys only before, each sorted by the largest
+// change and cut to top
+func compareCounts(before, after map[string]int, top int) (changed, added, vanished []CountDelta) {
+	keys := make(map[string]bool)
+	for _, item := range getSortedMapByValue(before, top) {
+		keys[item.Key] = true
+	}
+	for _, item := range getSortedMapByValue(after, top) {
+		keys[item.Key] = true
+	}
+
+	for key := range keys {
+		b, a := before[key], after[key]
+		delta := CountDelta{Key: key, Before: b, After: a, Change: a - b, Percent: relativeChange(float64(b), float64(a))}
+		switch {
+		case b == 0:
+			added = append(added, delta)
+		case a == 0:
+			vanished = append(vanished, delta)
+		case a != b:
+			changed = append(changed, delta)
+		}
+	}
+
+	for _, list := range []*[]CountDelta{&changed, &added, &vanished} {
+		deltas := *list
+		sort.Slice(deltas, func(i, j int) bool {
+			a, b := deltas[i].Change, deltas[j].Change
+			if a < 0 {
+				a = -a
+			}
+			if b < 0 {
+				b = -b
+			}
+			if a != b {
+				return a > b
+			}
+			return deltas[i].Key < deltas[j].Key
+		})
+		if len(deltas) > top {
+			*list = deltas[:top]
+		}
+	}
+	return changed, added, vanished
+}
+
+func mergeKeys(a, b map[int]int) map[int]bool {
+	keys := make(map[int]bool, len(a)+len(b))
+	for k := range a {
+		keys[k] = true
+	}
+	for k := range b {
+		keys[k] = true
+	}
+	return keys
+}
+
+// share returns n as a percentage of total
+func share(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total) * 100
+}
+
+func errorRate(stats *Stats) float64 {
+	return share(stats.TotalErrors, stats.TotalRequests)
+}
+
+// requestsPerActiveHour normalises volume for windows of different length
+func requestsPerActiveHour(stats *Stats) float64 {
+	if len(stats.RequestsPerHour) == 0 {
+		return 0
+	}
+	return float64(stats.TotalRequests) / float64(len(stats.RequestsPerHour))
+}
+
+func outputComparison(c *Comparison, format OutputFormat, csvDir string) error {
+	switch format {
+	case TextFormat:
+		return outputComparisonText(c)
+	case JSONFormat:
+		data, err := json.MarshalIndent(c, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal JSON: %w", err)
+		}
+		fmt.Println(string(data))
+		return nil
+	case CSVFormat:
+		return writeCSVSections(comparisonSections(c), csvDir)
+	default:
+		return fmt.Errorf("compare does not support -o %s (use text, json or csv)", format)
+	}
+}
+
+func outputComparisonText(c *Comparison) error {
+	fmt.Printf("Log Comparison\n")
+	fmt.Printf("==============\n\n")
+	fmt.Printf("  Before: %s\n", c.Before)
+	fmt.Printf("  After:  %s\n\n", c.After)
+
+	fmt.Printf("Summary:\n")
+	fmt.Printf("  %-20s %14s %14s  %s\n", "Metric", "Before", "After", "Change")
+	for _, m := range c.Metrics {
+		fmt.Printf("  %-20s %14s %14s  %s\n", m.Name,
+			formatMetric(m.Unit, m.Before), formatMetric(m.Unit, m.After), formatMetricChange(m))
+	}
+	fmt.Printf("\n")
+
+	fmt.Printf("Status Code Shifts (share of requests, at least %.0f point):\n", statusShiftPoints)
+	if len(c.StatusShifts) == 0 {
+		fmt.Printf("  None\n")
+	}
+	for _, s := range c.StatusShifts {
+		fmt.Printf("  %d: %.1f%% -> %.1f%% (%+.1f points, %d -> %d requests)\n",
+			s.Status, s.BeforeShare, s.AfterShare, s.Points, s.Before, s.After)
+	}
+	fmt.Printf("\n")
+
+	for _, section := range []struct {
+		title  string
+		deltas []CountDelta
+	}{
+		{"Top Page Changes", c.PageChanges},
+		{"New Top Pages", c.NewPages},
+		{"Vanished Top Pages", c.VanishedPages},
+		{"Top IP Changes", c.IPChanges},
+		{"New Top IPs", c.NewIPs},
+		{"Vanished Top IPs", c.VanishedIPs},
+	} {
+		fmt.Printf("%s:\n", section.title)
+		if len(section.deltas) == 0 {
+			fmt.Printf("  None\n")
+		}
+		for _, d := range section.deltas {
+			fmt.Printf("  %s: %d -> %d (%s)\n", truncate(d.Key, 80), d.Before, d.After, formatCountChange(d))
+		}
+		fmt.Printf("\n")
+	}
+	return nil
+}
+
+// formatMetric prints a summary value in its unit
+func formatMetric(unit string, value float64) string {
+	switch unit {
+	case "bytes":
+		return formatBytes(int64(value))
+	case "percent":
+		return fmt.Sprintf("%.2f%%", value)
+	case "ms":
+		return fmt.Sprintf("%.1fms", value)
+	}
+	return strconv.FormatFloat(math.Round(value*10)/10, 'f', -1, 64)
+}
+
+func formatMetricChange(m MetricDelta) string {
+	var change string
+	switch m.Unit {
+	case "bytes":
+		change = formatBytes(int64(math.Abs(m.Change)))
+		if m.Change < 0 {
+			change = "-" + change
+		} else {
+			change = "+" + change
+		}
+	case "percent":
+		// Rates change by points; a relative change of a rate misleads
+		return fmt.Sprintf("%+.2f points", m.Change)
+	case "ms":
+		change = fmt.Sprintf("%+.1fms", m.Change)
+	default:
+		change = fmt.Sprintf("%+g", math.Round(m.Change*10)/10)
+	}
+	if m.Percent != nil {
+		change += fmt.Sprintf(" (%+.1f%%)", *m.Percent)
+	}
+	return change
+}
+
+func formatCountChange(d CountDelta) string {
+	switch {
+	case d.Before == 0:
+		return "new"
+	case d.After == 0:
+		return "vanished"
+	}
+	return fmt.Sprintf("%+d, %+.1f%%", d.Change, *d.Percent)
+}
+
+// comparisonSections lays the comparison out as CSV sections
+func comparisonSections(c *Comparison) []csvSection {
+	percent := func(p *float64) string {
+		if p == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*p, 'f', -1, 64)
+	}
+	float := func(f float64) string {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+
+	metrics := csvSection{Name: "metrics", Header: []string{"metric", "unit", "before", "after", "change", "percent"}}
+	for _, m := range c.Metrics {
+		metrics.Rows = append(metrics.Rows, []string{m.Name, m.Unit, float(m.Before), float(m.After), float(m.Change), percent(m.Percent)})
+	}
+
+	shifts := csvSection{Name: "status_shifts", Header: []string{"status", "before", "after", "before_share", "after_share", "points"}}
+	for _, s := range c.StatusShifts {
+		shifts.Rows = append(shifts.Rows, []string{
+			strconv.Itoa(s.Status), strconv.Itoa(s.Before), strconv.Itoa(s.After),
+			float(s.BeforeShare), float(s.AfterShare), float(s.Points),
+		})
+	}
+	sections := []csvSection{metrics, shifts}
+
+	for _, list := range []struct {
+		name, key string
+		changes   [][]CountDelta
+	}{
+		{"page_changes", "page", [][]CountDelta{c.PageChanges, c.NewPages, c.VanishedPages}},
+		{"ip_changes", "ip", [][]CountDelta{c.IPChanges, c.NewIPs, c.VanishedIPs}},
+	} {
+		section := csvSection{Name: list.name, Header: []string{list.key, "kind", "before", "after", "change", "percent"}}
+		for i, kind := range []string{"changed", "new", "vanished"} {
+			for _, d := range list.changes[i] {
+				section.Rows = append(section.Rows, []string{
+					d.Key, kind, strconv.Itoa(d.Before), strconv.Itoa(d.After), strconv.Itoa(d.Change), percent(d.Percent),
+				})
+			}
+		}
+		sections = append(sections, section)
+	}
+	return sections
+}
+
+// ApproxStats holds the bounded-memory sketches used by -approx
+type ApproxStats struct {
+	Capacity    int
+	IPs         *SpaceSaving
+	Pages       *SpaceSaving
+	UserAgents  *SpaceSaving
+	UniqueIPs   *HyperLogLog
+	UniquePages *HyperLogLog
+	IPsPerHour  map[string]*SpaceSaving
+}
+
+func NewApproxStats(capacity int) *ApproxStats {
+	return &ApproxStats{
+		Capacity:    capacity,
+		IPs:         NewSpaceSaving(capacity),
+		Pages:       NewSpaceSaving(capacity),
+		UserAgents:  NewSpaceSaving(capacity),
+		UniqueIPs:   NewHyperLogLog(),
+		UniquePages: NewHyperLogLog(),
+		IPsPerHour:  make(map[string]*SpaceSaving),
+	}
+}
+
+func (a *ApproxStats) Merge(other *ApproxStats) {
+	a.IPs.Merge(other.IPs)
+	a.Pages.Merge(other.Pages)
+	a.UserAgents.Merge(other.UserAgents)
+	a.UniqueIPs.Merge(other.UniqueIPs)
+	a.UniquePages.Merge(other.UniquePages)
+	for hour, ips := range other.IPsPerHour {
+		mine, ok := a.IPsPerHour[hour]
+		if !ok {
+			mine = NewSpaceSaving(hourlyIPCounters)
+			a.IPsPerHour[hour] = mine
+		}
+		mine.Merge(ips)
+	}
+}
+
+// MarshalJSON reports the error bounds; the estimates themselves are in
+// the regular top lists and unique counts
+func (a *ApproxStats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"counters":                   a.Capacity,
+		"ip_count_max_error":         a.IPs.MaxError(),
+		"page_count_max_error":       a.Pages.MaxError(),
+		"user_agent_count_max_error": a.UserAgents.MaxError(),
+		"unique_relative_error":      a.UniqueIPs.RelativeError(),
+	})
+}
+
+// SpaceSaving tracks the most frequent keys with a fixed number of
+// counters (Metwally et al.). A new key replaces the smallest counter and
+// inherits its count, so counts are overstated by at most that minimum.
+type SpaceSaving struct {
+	Capacity int
+	counters map[string]*ssCounter
+	heap     ssHeap
+}
+
+type ssCounter struct {
+	key   string
+	count int
+	err   int
+	index int
+}
+
+func NewSpaceSaving(capacity int) *SpaceSaving {
+	return &SpaceSaving{Capacity: capacity, counters: make(map[string]*ssCounter)}
+}
+
+// Add counts key n times and reports the key it evicted, if any
+func (s *SpaceSaving) Add(key string, n int) (string, bool) {
+	if c, ok := s.counters[key]; ok {
+		c.count += n
+		heap.Fix(&s.heap, c.index)
+		return "", false
+	}
+
+	if len(s.counters) < s.Capacity {
+		c := &ssCounter{key: key, count: n}
+		s.counters[key] = c
+		heap.Push(&s.heap, c)
+		return "", false
+	}
+
+	// Reuse the smallest counter for the new key
+	c := s.heap[0]
+	evicted := c.key
+	delete(s.counters, evicted)
+	c.key, c.err, c.count = key, c.count, c.count+n
+	s.counters[key] = c
+	heap.Fix(&s.heap, 0)
+	return evicted, true
+}
+
+func (s *SpaceSaving) Tracked(key string) bool {
+	_, ok := s.counters[key]
+	return ok
+}
+
+// MaxError is the largest overstatement of any reported count
+func (s *SpaceSaving) MaxError() int {
+	max := 0
+	for _, c := range s.counters {
+		if c.err > max {
+			max = c.err
+		}
+	}
+	return max
+}
+
+// Counts returns the estimated count of every tracked key
+func (s *SpaceSaving) Counts() map[string]int {
+	counts := make(map[string]int, len(s.counters))
+	for key, c := range s.counters {
+		counts[key] = c.count
+	}
+	return counts
+}
+
+// Merge combines two summaries (Agarwal et al.): a key missing from a full
+// summary may have occurred up to that summary's minimum count
+func (s *SpaceSaving) Merge(other *SpaceSaving) {
+	minOf := func(x *SpaceSaving) int {
+		if len(x.counters) < x.Capacity || len(x.heap) == 0 {
+			return 0
+		}
+		return x.heap[0].count
+	}
+	mine, theirs := minOf(s), minOf(other)
+
+	merged := make(map[string]*ssCounter)
+	for key, c := range s.counters {
+		merged[key] = &ssCounter{key: key, count: c.count, err: c.err}
+	}
+	for key, c := range other.counters {
+		if m, ok := merged[key]; ok {
+			m.count += c.count
+			m.err += c.err
+		} else {
+			merged[key] = &ssCounter{key: key, count: c.count + mine, err: c.err + mine}
+		}
+	}
+	for key, m := range merged {
+		if _, ok := other.counters[key]; !ok {
+			m.count += theirs
+			m.err += theirs
+		}
+	}
+
+	all := make([]*ssCounter, 0, len(merged))
+	for _, c := range merged {
+		all = append(all, c)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].count != all[j].count {
+			return all[i].count > all[j].count
+		}
+		return all[i].key < all[j].key
+	})
+	if len(all) > s.Capacity {
+		all = all[:s.Capacity]
+	}
+
+	s.counters = make(map[string]*ssCounter, len(all))
+	s.heap = s.heap[:0]
+	for _, c := range all {
+		s.counters[c.key] = c
+		heap.Push(&s.heap, c)
+	}
+}
+
+// ssHeap is a min-heap of counters by count
+type ssHeap []*ssCounter
+
+func (h ssHeap) Len() int           { return len(h) }
+func (h ssHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h ssHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *ssHeap) Push(x interface{}) {
+	c := x.(*ssCounter)
+	c.index = len(*h)
+	*h = append(*h, c)
+}
+func (h *ssHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// HyperLogLog precision: 2^14 registers, about 0.8% standard error in 16 KB
+const hllPrecision = 14
+
+// HyperLogLog estimates the number of distinct keys in fixed memory
+type HyperLogLog struct {
+	registers []uint8
+}
+
+func NewHyperLogLog() *HyperLogLog {
+	return &HyperLogLog{registers: make([]uint8, 1<<hllPrecision)}
+}
+
+func (h *HyperLogLog) Add(key string) {
+	hash := hashKey(key)
+	index := hash >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(hash<<hllPrecision|1<<(hllPrecision-1))) + 1
+	if rank > h.registers[index] {
+		h.registers[index] = rank
+	}
+}
+
+func (h *HyperLogLog) Merge(other *HyperLogLog) {
+	for i, r := range other.registers {
+		if r > h.registers[i] {
+			h.registers[i] = r
+		}
+	}
+}
+
+func (h *HyperLogLog) Estimate() float64 {
+	m := float64(len(h.registers))
+	sum, zeros := 0.0, 0
+	for _, r := range h.registers {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	// Small cardinalities are more accurate with linear counting
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return math.Round(estimate)
+}
+
+// RelativeError is the standard error of the estimate
+func (h *HyperLogLog) RelativeError() float64 {
+	return 1.04 / math.Sqrt(float64(len(h.registers)))
+}
+
+// hashKey is 64-bit FNV-1a followed by a finalizer that spreads the bits
+// of similar keys such as neighbouring IP addresses
+func hashKey(key string) uint64 {
+	hasher := fnv.New64a()
+	hasher.Write([]byte(key))
+	h := hasher.Sum64()
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// GroupBy describes a -group-by / -bucket query
+type GroupBy struct {
+	Fields []string
+	Bucket time.Duration
+}
+
+// GroupRow aggregates the entries sharing a time bucket and field values
+type GroupRow struct {
+	Bucket   time.Time
+	Values   []string
+	Requests int
+	Bytes    int64
+	Errors   int
+}
+
+func (r *GroupRow) ErrorRate() float64 {
+	if r.Requests == 0 {
+		return 0
+	}
+	return float64(r.Errors) / float64(r.Requests)
+}
+
+// GroupReport collects GroupRows keyed by bucket and field values
+type GroupReport struct {
+	GroupBy
+	rows map[string]*GroupRow
+}
+
+func NewGroupReport(by GroupBy) *GroupReport {
+	return &GroupReport{GroupBy: by, rows: make(map[string]*GroupRow)}
+}
+
+func (g *GroupReport) Add(entry *LogEntry) {
+	var bucket time.Time
+	if g.Bucket > 0 {
+		bucket = entry.Timestamp.Truncate(g.Bucket)
+	}
+	values := make([]string, len(g.Fields))
+	for i, field := range g.Fields {
+		value, ok := entry.Field(field)
+		if !ok || value == "" {
+			value = "-"
+		}
+		values[i] = value
+	}
+
+	key := bucket.Format(time.RFC3339) + "\x00" + strings.Join(values, "\x00")
+	row, ok := g.rows[key]
+	if !ok {
+		row = &GroupRow{Bucket: bucket, Values: values}
+		g.rows[key] = row
+	}
+	row.Requests++
+	row.Bytes += entry.Size
+	if entry.Status >= 400 {
+		row.Errors++
+	}
+}
+
+// Merge adds the rows of another report with the same grouping
+func (g *GroupReport) Merge(other *GroupReport) {
+	for key, row := range other.rows {
+		existing, ok := g.rows[key]
+		if !ok {
+			copied := *row
+			g.rows[key] = &copied
+			continue
+		}
+		existing.Requests += row.Requests
+		existing.Bytes += row.Bytes
+		existing.Errors += row.Errors
+	}
+}
 
-		// Apply time filter
-		if !la.isWithinTimeRange(entry.Timestamp) {
-			continue
+// Rows returns the groups in time order, busiest first within a bucket
+func (g *GroupReport) Rows() []*GroupRow {
+	rows := make([]*GroupRow, 0, len(g.rows))
+	for _, row := range g.rows {
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if !a.Bucket.Equal(b.Bucket) {
+			return a.Bucket.Before(b.Bucket)
+		}
+		if a.Requests != b.Requests {
+			return a.Requests > b.Requests
 		}
+		return strings.Join(a.Values, "\x00") < strings.Join(b.Values, "\x00")
+	})
+	return rows
+}
 
-		la.updateStats(entry, stats)
-		stats.TotalRequests++
-		stats.TotalBytes += entry.Size
+// Records renders the groups as CSV rows with a header
+func (g *GroupReport) Records() [][]string {
+	var header []string
+	if g.Bucket > 0 {
+		header = append(header, "bucket")
+	}
+	header = append(header, g.Fields...)
+	header = append(header, "requests", "bytes", "errors", "error_rate")
 
-		// Collect error entries
-		if entry.Status >= 400 {
-			stats.ErrorEntries = append(stats.ErrorEntries, *entry)
+	records := [][]string{header}
+	for _, row := range g.Rows() {
+		var record []string
+		if g.Bucket > 0 {
+			record = append(record, row.Bucket.Format(time.RFC3339))
 		}
+		record = append(record, row.Values...)
+		record = append(record,
+			strconv.Itoa(row.Requests),
+			strconv.FormatInt(row.Bytes, 10),
+			strconv.Itoa(row.Errors),
+			strconv.FormatFloat(row.ErrorRate(), 'f', 4, 64),
+		)
+		records = append(records, record)
 	}
+	return records
+}
 
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("error reading file: %w", err)
+func (g *GroupReport) MarshalJSON() ([]byte, error) {
+	rows := make([]map[string]interface{}, 0, len(g.rows))
+	for _, row := range g.Rows() {
+		item := map[string]interface{}{
+			"requests":   row.Requests,
+			"bytes":      row.Bytes,
+			"errors":     row.Errors,
+			"error_rate": row.ErrorRate(),
+		}
+		if g.Bucket > 0 {
+			item["bucket"] = row.Bucket.Format(time.RFC3339)
+		}
+		for i, field := range g.Fields {
+			item[field] = row.Values[i]
+		}
+		rows = append(rows, item)
 	}
-
-	if la.Verbose {
-		fmt.Printf("Processed %d lines, %d valid entries, %d errors\n",
-			lineNum, stats.TotalRequests, stats.ParseErrors)
+	report := map[string]interface{}{
+		"fields": g.Fields,
+		"rows":   rows,
 	}
-
-	return stats, nil
+	if g.Bucket > 0 {
+		report["bucket"] = g.Bucket.String()
+	}
+	return json.Marshal(report)
 }
 
-func (la *LogAnalyzer) parseLogLine(line string, pattern *regexp.Regexp, lineNum int) (*LogEntry, error) {
-	matches := pattern.FindStringSubmatch(line)
-	if len(matches) < 9 {
-		return nil, fmt.Errorf("line doesn't match expected format")
+// printGroupReport prints a flat table, or with both a bucket and fields
+// a pivot of requests with buckets as rows and the busiest groups as columns
+func printGroupReport(g *GroupReport, topCount int) {
+	label := strings.Join(g.Fields, ", ")
+	if g.Bucket > 0 {
+		if label != "" {
+			label += " per "
+		}
+		label += g.Bucket.String()
 	}
+	fmt.Printf("Grouped by %s:\n", label)
 
-	// Parse IP
-	ip := matches[1]
-
-	// Parse timestamp
-	timestampStr := matches[2]
-	timestamp, err := time.Parse("02/Jan/2006:15:04:05 -0700", timestampStr)
-	if err != nil {
-		return nil, fmt.Errorf("invalid timestamp format: %w", err)
+	rows := g.Rows()
+	if g.Bucket == 0 || len(g.Fields) == 0 {
+		printGroupTable(g, rows, topCount)
+		return
 	}
 
-	// Parse request components
-	method := matches[3]
-	url := matches[4]
-	protocol := matches[5]
-
-	// Parse status code
-	status, err := strconv.Atoi(matches[6])
-	if err != nil {
-		return nil, fmt.Errorf("invalid status code: %w", err)
+	// Pick the busiest field combinations as pivot columns
+	totals := make(map[string]int)
+	for _, row := range rows {
+		totals[strings.Join(row.Values, " / ")] += row.Requests
 	}
-
-	// Parse size
-	var size int64
-	if matches[7] != "-" {
-		size, err = strconv.ParseInt(matches[7], 10, 64)
-		if err != nil {
-			size = 0 // Ignore size parsing errors
-		}
+	var columns []string
+	for _, item := range getSortedMapByValue(totals, topCount) {
+		columns = append(columns, item.Key)
 	}
+	other := len(totals) > len(columns)
 
-	// Parse referer and user agent (optional fields)
-	var referer, userAgent string
-	if len(matches) > 8 {
-		referer = matches[8]
+	type pivotRow struct {
+		bucket time.Time
+		cells  map[string]int
+		total  int
 	}
-	if len(matches) > 9 {
-		userAgent = matches[9]
+	var pivot []*pivotRow
+	for _, row := range rows {
+		if len(pivot) == 0 || !pivot[len(pivot)-1].bucket.Equal(row.Bucket) {
+			pivot = append(pivot, &pivotRow{bucket: row.Bucket, cells: make(map[string]int)})
+		}
+		p := pivot[len(pivot)-1]
+		column := strings.Join(row.Values, " / ")
+		if contains(columns, column) {
+			p.cells[column] += row.Requests
+		} else {
+			p.cells["(other)"] += row.Requests
+		}
+		p.total += row.Requests
+	}
+	if other {
+		columns = append(columns, "(other)")
 	}
 
-	return &LogEntry{
-		IP:        ip,
-		Timestamp: timestamp,
-		Method:    method,
-		URL:       url,
-		Protocol:  protocol,
-		Status:    status,
-		Size:      size,
-		Referer:   referer,
-		UserAgent: userAgent,
-	}, nil
-}
+	widths := make([]int, len(columns))
+	for i, column := range columns {
+		widths[i] = len(truncate(column, 24))
+		if widths[i] < 6 {
+			widths[i] = 6
+		}
+	}
 
-func (la *LogAnalyzer) isWithinTimeRange(timestamp time.Time) bool {
-	if !la.StartTime.IsZero() && timestamp.Before(la.StartTime) {
-		return false
+	fmt.Printf("  %-16s", "Bucket")
+	for i, column := range columns {
+		fmt.Printf(" %*s", widths[i], truncate(column, 24))
 	}
-	if !la.EndTime.IsZero() && timestamp.After(la.EndTime) {
-		return false
+	fmt.Printf(" %8s\n", "Total")
+	for _, p := range pivot {
+		fmt.Printf("  %-16s", p.bucket.Format("2006-01-02 15:04"))
+		for i, column := range columns {
+			fmt.Printf(" %*d", widths[i], p.cells[column])
+		}
+		fmt.Printf(" %8d\n", p.total)
 	}
-	return true
+	fmt.Printf("\n")
 }
 
-func (la *LogAnalyzer) updateStats(entry *LogEntry, stats *Stats) {
-	// Status codes
-	stats.StatusCodes[entry.Status]++
+// printGroupTable prints one line per group with its totals
+func printGroupTable(g *GroupReport, rows []*GroupRow, topCount int) {
+	var header []string
+	if g.Bucket > 0 {
+		header = append(header, "Bucket")
+	}
+	header = append(header, g.Fields...)
 
-	// Top IPs
-	stats.TopIPs[entry.IP]++
+	// Without time buckets only the busiest groups are shown
+	if g.Bucket == 0 && len(rows) > topCount {
+		rows = rows[:topCount]
+	}
 
-	// Top pages (ignore query parameters for grouping)
-	url := entry.URL
-	if idx := strings.Index(url, "?"); idx > 0 {
-		url = url[:idx]
+	cells := make([][]string, len(rows))
+	widths := make([]int, len(header))
+	for i, h := range header {
+		widths[i] = len(h)
+	}
+	for r, row := range rows {
+		if g.Bucket > 0 {
+			cells[r] = append(cells[r], row.Bucket.Format("2006-01-02 15:04"))
+		}
+		for _, value := range row.Values {
+			cells[r] = append(cells[r], truncate(value, 40))
+		}
+		for i, cell := range cells[r] {
+			if len(cell) > widths[i] {
+				widths[i] = len(cell)
+			}
+		}
 	}
-	stats.TopPages[url]++
 
-	// User agents
-	if entry.UserAgent != "" {
-		stats.TopUserAgents[entry.UserAgent]++
+	fmt.Printf(" ")
+	for i, h := range header {
+		fmt.Printf(" %-*s", widths[i], h)
+	}
+	fmt.Printf(" %8s %10s %7s\n", "Requests", "Bytes", "Errors")
+	for r, row := range rows {
+		fmt.Printf(" ")
+		for i, cell := range cells[r] {
+			fmt.Printf(" %-*s", widths[i], cell)
+		}
+		fmt.Printf(" %8d %10s %6.1f%%\n", row.Requests, formatBytes(row.Bytes), row.ErrorRate()*100)
 	}
+	fmt.Printf("\n")
+}
 
-	// Requests per hour
-	hourKey := entry.Timestamp.Format("2006-01-02 15:00")
-	stats.RequestsPerHour[hourKey]++
+func truncate(s string, max int) string {
+	if len(s) > max {
+		return s[:max-3] + "..."
+	}
+	return s
+}
 
-	// Requests per day
-	dayKey := entry.Timestamp.Format("2006-01-02")
-	stats.RequestsPerDay[dayKey]++
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
 }
 
-func outputResults(stats *Stats, format OutputFormat, topCount int) error {
+func outputResults(stats *Stats, format OutputFormat, topCount int, csvDir string) error {
 	switch format {
 	case TextFormat:
 		return outputTextResults(stats, topCount)
 	case JSONFormat:
 		return outputJSONResults(stats)
 	case CSVFormat:
-		return outputCSVResults(stats)
+		return outputCSVResults(stats, csvDir)
+	case HTMLFormat:
+		return outputHTMLResults(stats, topCount)
 	default:
 		return fmt.Errorf("unsupported output format: %s", format)
 	}
@@ -335,8 +5285,33 @@ func outputTextResults(stats *Stats, topCount int) error {
 	fmt.Printf("  Total Requests: %d\n", stats.TotalRequests)
 	fmt.Printf("  Total Bytes: %s\n", formatBytes(stats.TotalBytes))
 	fmt.Printf("  Parse Errors: %d\n", stats.ParseErrors)
+	if a := stats.Approx; a != nil {
+		fmt.Printf("  Unique IPs: ~%d (±%.1f%%)\n", stats.UniqueIPs, a.UniqueIPs.RelativeError()*100)
+		fmt.Printf("  Unique Pages: ~%d (±%.1f%%)\n", stats.UniquePages, a.UniquePages.RelativeError()*100)
+	} else {
+		fmt.Printf("  Unique IPs: %d\n", stats.UniqueIPs)
+		fmt.Printf("  Unique Pages: %d\n", stats.UniquePages)
+	}
 	fmt.Printf("\n")
 
+	// Error bounds of the approximate top lists
+	if a := stats.Approx; a != nil {
+		fmt.Printf("Approximation (%d counters per list):\n", a.Capacity)
+		fmt.Printf("  Top IP counts overstated by at most %d\n", a.IPs.MaxError())
+		fmt.Printf("  Top page counts overstated by at most %d\n", a.Pages.MaxError())
+		fmt.Printf("  Top user agent counts overstated by at most %d\n", a.UserAgents.MaxError())
+		fmt.Printf("\n")
+	}
+
+	// Per-file breakdown when several inputs were merged
+	if len(stats.RequestsPerFile) > 1 {
+		fmt.Printf("Requests per File:\n")
+		for _, name := range getSortedKeys(stats.RequestsPerFile) {
+			fmt.Printf("  %s: %d\n", name, stats.RequestsPerFile[name])
+		}
+		fmt.Printf("\n")
+	}
+
 	// Status code distribution
 	fmt.Printf("Status Code Distribution:\n")
 	printTopMapInt(stats.StatusCodes, topCount, "Status", "Count")
@@ -357,6 +5332,17 @@ func outputTextResults(stats *Stats, topCount int) error {
 	printTopMapString(stats.TopUserAgents, topCount, "User Agent", "Requests")
 	fmt.Printf("\n")
 
+	// Origins, when -ipdb is given
+	if stats.TopCountries != nil {
+		fmt.Printf("Top Countries:\n")
+		printTopMap(stats.TopCountries, topCount, "Country", "Requests")
+		fmt.Printf("\nTop Networks:\n")
+		printTopMapString(stats.TopNetworks, topCount, "Network", "Requests")
+		fmt.Printf("\nTop Labels:\n")
+		printTopMap(stats.TopLabels, topCount, "Label", "Requests")
+		fmt.Printf("\n")
+	}
+
 	// Hourly requests (last 24 hours)
 	fmt.Printf("Requests per Hour (last 24 hours):\n")
 	hours := getSortedKeys(stats.RequestsPerHour)
@@ -370,20 +5356,62 @@ func outputTextResults(stats *Stats, topCount int) error {
 	}
 	fmt.Printf("\n")
 
+	// Response times, when the log records them
+	if stats.Latency != nil {
+		printLatencySection(stats, topCount)
+	}
+
+	// Group-by report
+	if stats.Groups != nil {
+		printGroupReport(stats.Groups, topCount)
+	}
+
+	// Anomalies against the rolling baseline
+	fmt.Printf("Anomalies:\n")
+	if len(stats.Anomalies) == 0 {
+		fmt.Printf("  None detected\n")
+	}
+	for _, a := range stats.Anomalies {
+		fmt.Printf("  [%s] %s\n", a.Window, a.Description)
+	}
+	fmt.Printf("\n")
+
+	// Threshold alerts from -rules
+	if stats.Alerts != nil {
+		fmt.Printf("Alert Violations:\n")
+		if len(stats.Violations) == 0 {
+			fmt.Printf("  None (%d rules checked)\n", len(stats.Alerts.Rules))
+		}
+		for _, v := range stats.Violations {
+			fmt.Printf("  [%s] %s\n", v.Window, v.Description)
+		}
+		fmt.Printf("\n")
+	}
+
 	// Error analysis
-	if len(stats.ErrorEntries) > 0 {
+	if stats.TotalErrors > 0 {
 		fmt.Printf("Error Analysis:\n")
-		fmt.Printf("  Total Errors: %d\n", len(stats.ErrorEntries))
+		fmt.Printf("  Total Errors: %d\n", stats.TotalErrors)
+		if len(stats.ErrorEntries) < stats.TotalErrors {
+			fmt.Printf("  Error Entries Kept: %d\n", len(stats.ErrorEntries))
+		}
 
 		// Count errors by status code
 		errorStats := make(map[int]int)
-		for _, entry := range stats.ErrorEntries {
-			errorStats[entry.Status]++
+		for status, count := range stats.StatusCodes {
+			if status >= 400 {
+				errorStats[status] = count
+			}
 		}
 
 		fmt.Printf("  Error Breakdown:\n")
-		for status, count := range errorStats {
-			fmt.Printf("    %d: %d\n", status, count)
+		statuses := make([]int, 0, len(errorStats))
+		for status := range errorStats {
+			statuses = append(statuses, status)
+		}
+		sort.Ints(statuses)
+		for _, status := range statuses {
+			fmt.Printf("    %d: %d\n", status, errorStats[status])
 		}
 		fmt.Printf("\n")
 	}
@@ -401,32 +5429,545 @@ func outputJSONResults(stats *Stats) error {
 	return nil
 }
 
-func outputCSVResults(stats *Stats) error {
+// outputCSVResults writes every section either as one file per section in
+// dir, or to stdout as a long table of section,key,field,value rows. A
+// group-by query on stdout prints just its rows.
+func outputCSVResults(stats *Stats, dir string) error {
+	if stats.Groups != nil && dir == "" {
+		writer := csv.NewWriter(os.Stdout)
+		writer.WriteAll(stats.Groups.Records())
+		return writer.Error()
+	}
+	return writeCSVSections(csvSections(stats), dir)
+}
+
+// writeCSVSections writes one file per section into dir, or a long table
+// to stdout
+func writeCSVSections(sections []csvSection, dir string) error {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create CSV directory: %w", err)
+		}
+		for _, section := range sections {
+			if err := writeCSVFile(filepath.Join(dir, section.Name+".csv"), section.Records()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
 	writer := csv.NewWriter(os.Stdout)
-	defer writer.Flush()
+	writer.Write([]string{"section", "key", "field", "value"})
+	for _, section := range sections {
+		for _, row := range section.Rows {
+			for i := 1; i < len(section.Header); i++ {
+				writer.Write([]string{section.Name, row[0], section.Header[i], row[i]})
+			}
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
 
-	// Write header
-	header := []string{"Metric", "Value"}
-	if err := writer.Write(header); err != nil {
-		return err
+func writeCSVFile(path string, records [][]string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	writer := csv.NewWriter(file)
+	writer.WriteAll(records)
+	if err := writer.Error(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return file.Close()
+}
+
+// csvSection is one table of the CSV export; the first column is its key
+type csvSection struct {
+	Name   string
+	Header []string
+	Rows   [][]string
+}
+
+func (s csvSection) Records() [][]string {
+	return append([][]string{s.Header}, s.Rows...)
+}
+
+// csvSections lays out every part of the stats as tables
+func csvSections(stats *Stats) []csvSection {
+	itoa := strconv.Itoa
+	i64 := func(n int64) string { return strconv.FormatInt(n, 10) }
+
+	summary := csvSection{Name: "summary", Header: []string{"metric", "value"}, Rows: [][]string{
+		{"total_requests", itoa(stats.TotalRequests)},
+		{"total_bytes", i64(stats.TotalBytes)},
+		{"total_errors", itoa(stats.TotalErrors)},
+		{"unique_ips", itoa(stats.UniqueIPs)},
+		{"unique_pages", itoa(stats.UniquePages)},
+		{"parse_errors", itoa(stats.ParseErrors)},
+	}}
+	if a := stats.Approx; a != nil {
+		summary.Rows = append(summary.Rows,
+			[]string{"approx_counters", itoa(a.Capacity)},
+			[]string{"ip_count_max_error", itoa(a.IPs.MaxError())},
+			[]string{"page_count_max_error", itoa(a.Pages.MaxError())},
+			[]string{"user_agent_count_max_error", itoa(a.UserAgents.MaxError())},
+			[]string{"unique_relative_error", strconv.FormatFloat(a.UniqueIPs.RelativeError(), 'f', 4, 64)},
+		)
 	}
+	sections := []csvSection{summary}
 
-	// Write summary statistics
-	records := [][]string{
-		{"Total Requests", strconv.Itoa(stats.TotalRequests)},
-		{"Total Bytes", strconv.FormatInt(stats.TotalBytes, 10)},
-		{"Parse Errors", strconv.Itoa(stats.ParseErrors)},
+	status := csvSection{Name: "status_codes", Header: []string{"status", "requests"}}
+	for _, item := range statusItems(stats.StatusCodes) {
+		status.Rows = append(status.Rows, []string{item.Key, itoa(item.Value)})
 	}
+	sections = append(sections, status)
 
-	for _, record := range records {
-		if err := writer.Write(record); err != nil {
-			return err
+	for _, top := range []struct {
+		name, key string
+		counts    map[string]int
+	}{
+		{"top_ips", "ip", stats.TopIPs},
+		{"top_pages", "page", stats.TopPages},
+		{"top_user_agents", "user_agent", stats.TopUserAgents},
+		{"requests_per_file", "file", stats.RequestsPerFile},
+		{"top_countries", "country", stats.TopCountries},
+		{"top_networks", "network", stats.TopNetworks},
+		{"top_labels", "label", stats.TopLabels},
+	} {
+		if top.counts == nil {
+			continue
 		}
+		section := csvSection{Name: top.name, Header: []string{top.key, "requests"}}
+		for _, item := range getSortedMapByValue(top.counts, len(top.counts)) {
+			section.Rows = append(section.Rows, []string{item.Key, itoa(item.Value)})
+		}
+		sections = append(sections, section)
 	}
 
-	return nil
+	for _, series := range []struct {
+		name, key string
+		requests  map[string]int
+		errors    map[string]int
+		bytes     map[string]int64
+	}{
+		{"requests_per_hour", "hour", stats.RequestsPerHour, stats.ErrorsPerHour, stats.BytesPerHour},
+		{"requests_per_day", "day", stats.RequestsPerDay, stats.ErrorsPerDay, stats.BytesPerDay},
+	} {
+		section := csvSection{Name: series.name, Header: []string{series.key, "requests", "errors", "bytes"}}
+		for _, key := range getSortedKeys(series.requests) {
+			section.Rows = append(section.Rows, []string{
+				key, itoa(series.requests[key]), itoa(series.errors[key]), i64(series.bytes[key]),
+			})
+		}
+		sections = append(sections, section)
+	}
+
+	if stats.Latency != nil {
+		header := []string{"scope", "count", "mean_ms", "p50_ms", "p90_ms", "p95_ms", "p99_ms", "max_ms"}
+		row := func(scope string, l *LatencySketch) []string {
+			return []string{scope, itoa(l.Count), formatMillis(l.Mean()),
+				formatMillis(l.Quantile(0.5)), formatMillis(l.Quantile(0.9)),
+				formatMillis(l.Quantile(0.95)), formatMillis(l.Quantile(0.99)), formatMillis(l.Max)}
+		}
+
+		latency := csvSection{Name: "latency", Header: header, Rows: [][]string{row("all", stats.Latency)}}
+		for _, class := range getSortedSketchKeys(stats.LatencyByStatus) {
+			latency.Rows = append(latency.Rows, row(class, stats.LatencyByStatus[class]))
+		}
+		byPage := csvSection{Name: "latency_by_page", Header: append([]string{"page"}, header[1:]...)}
+		for _, page := range getSortedSketchKeys(stats.LatencyByPage) {
+			byPage.Rows = append(byPage.Rows, row(page, stats.LatencyByPage[page]))
+		}
+		histogram := csvSection{Name: "latency_histogram", Header: []string{"le", "count"}}
+		for _, b := range stats.Latency.Buckets() {
+			histogram.Rows = append(histogram.Rows, []string{b.LE, itoa(b.Count)})
+		}
+		sections = append(sections, latency, byPage, histogram)
+	}
+
+	if stats.Groups != nil {
+		records := stats.Groups.Records()
+		sections = append(sections, csvSection{Name: "groups", Header: records[0], Rows: records[1:]})
+	}
+
+	anomalies := csvSection{Name: "anomalies", Header: []string{"window", "metric", "value", "baseline", "score", "description"}}
+	for _, a := range stats.Anomalies {
+		anomalies.Rows = append(anomalies.Rows, []string{
+			a.Window, a.Metric,
+			strconv.FormatFloat(a.Value, 'f', -1, 64),
+			strconv.FormatFloat(a.Baseline, 'f', -1, 64),
+			strconv.FormatFloat(a.Score, 'f', -1, 64),
+			a.Description,
+		})
+	}
+	sections = append(sections, anomalies)
+
+	if stats.Alerts != nil {
+		violations := csvSection{Name: "violations", Header: []string{"rule", "window", "metric", "value", "op", "threshold"}}
+		for _, v := range stats.Violations {
+			violations.Rows = append(violations.Rows, []string{
+				v.Rule, v.Window, v.Metric,
+				strconv.FormatFloat(v.Value, 'f', -1, 64),
+				v.Op,
+				strconv.FormatFloat(v.Threshold, 'f', -1, 64),
+			})
+		}
+		sections = append(sections, violations)
+	}
+
+	errors := csvSection{Name: "error_entries", Header: []string{
+		"entry", "timestamp", "ip", "method", "url", "protocol", "status", "size",
+		"duration_ms", "user_agent", "referer", "host", "file",
+	}}
+	for i, e := range stats.ErrorEntries {
+		duration := ""
+		if e.Timed {
+			duration = formatMillis(e.Duration)
+		}
+		errors.Rows = append(errors.Rows, []string{
+			itoa(i + 1), e.Timestamp.Format(time.RFC3339), e.IP, e.Method, e.URL, e.Protocol,
+			itoa(e.Status), i64(e.Size), duration, e.UserAgent, e.Referer, e.Host, e.Source,
+		})
+	}
+	sections = append(sections, errors)
+
+	return sections
+}
+
+// Chart geometry for the HTML report, in SVG user units
+const (
+	chartWidth  = 900
+	chartHeight = 220
+	barHeight   = 20
+	labelWidth  = 260
+)
+
+type htmlReport struct {
+	Generated  string
+	Summary    []htmlItem
+	Timeline   timelineChart
+	Status     barChart
+	Pages      barChart
+	IPs        barChart
+	Tables     []htmlTable
+	Anomalies  []Anomaly
+	Violations []Violation
+	HasLatency bool
+}
+
+type htmlItem struct {
+	Label string
+	Value string
+}
+
+type timelineChart struct {
+	Width, Height int
+	Bars          []timelineBar
+	Max           int
+	First, Last   string
+}
+
+type timelineBar struct {
+	X, Y, W, H float64
+	Label      string
+	Value      int
+}
+
+type barChart struct {
+	Width, Height int
+	Bars          []chartBar
+}
+
+type chartBar struct {
+	X, Y, W, H    float64
+	TextY, ValueX float64
+	Label         string
+	Value         int
+}
+
+type htmlTable struct {
+	Title   string
+	Headers []string
+	Numeric []bool
+	Rows    [][]htmlCell
+}
+
+// htmlCell carries display text and a sort key for numeric columns
+type htmlCell struct {
+	Text string
+	Sort string
+}
+
+// outputHTMLResults writes a single self-contained HTML page with inline
+// SVG charts and sortable tables
+func outputHTMLResults(stats *Stats, topCount int) error {
+	report := htmlReport{
+		Generated: time.Now().Format("2006-01-02 15:04:05 MST"),
+		Summary: []htmlItem{
+			{"Total Requests", strconv.Itoa(stats.TotalRequests)},
+			{"Total Bytes", formatBytes(stats.TotalBytes)},
+			{"Errors", strconv.Itoa(stats.TotalErrors)},
+			{"Unique IPs", strconv.Itoa(stats.UniqueIPs)},
+			{"Unique Pages", strconv.Itoa(stats.UniquePages)},
+			{"Parse Errors", strconv.Itoa(stats.ParseErrors)},
+		},
+		Timeline:   newTimelineChart(stats.RequestsPerHour),
+		Status:     newBarChart(statusItems(stats.StatusCodes)),
+		Pages:      newBarChart(getSortedMapByValue(stats.TopPages, topCount)),
+		IPs:        newBarChart(getSortedMapByValue(stats.TopIPs, topCount)),
+		Anomalies:  stats.Anomalies,
+		Violations: stats.Violations,
+		HasLatency: stats.Latency != nil,
+	}
+	if l := stats.Latency; l != nil {
+		report.Summary = append(report.Summary,
+			htmlItem{"Latency p50", formatLatency(l.Quantile(0.5))},
+			htmlItem{"Latency p99", formatLatency(l.Quantile(0.99))})
+	}
+
+	report.Tables = append(report.Tables,
+		countTable("Top Pages", "Page", getSortedMapByValue(stats.TopPages, topCount), stats.TotalRequests),
+		countTable("Top IP Addresses", "IP", getSortedMapByValue(stats.TopIPs, topCount), stats.TotalRequests),
+		countTable("Top User Agents", "User Agent", getSortedMapByValue(stats.TopUserAgents, topCount), stats.TotalRequests),
+	)
+	if stats.TopCountries != nil {
+		report.Tables = append(report.Tables,
+			countTable("Top Countries", "Country", getSortedMapByValue(stats.TopCountries, topCount), stats.TotalRequests),
+			countTable("Top Networks", "Network", getSortedMapByValue(stats.TopNetworks, topCount), stats.TotalRequests),
+			countTable("Top Labels", "Label", getSortedMapByValue(stats.TopLabels, topCount), stats.TotalRequests),
+		)
+	}
+	if stats.Latency != nil {
+		report.Tables = append(report.Tables, latencyTable(stats, topCount))
+	}
+
+	tmpl, err := template.New("report").Parse(htmlReportTemplate)
+	if err != nil {
+		return fmt.Errorf("failed to parse HTML template: %w", err)
+	}
+	writer := bufio.NewWriter(os.Stdout)
+	if err := tmpl.Execute(writer, report); err != nil {
+		return fmt.Errorf("failed to render HTML: %w", err)
+	}
+	return writer.Flush()
+}
+
+func newTimelineChart(perHour map[string]int) timelineChart {
+	chart := timelineChart{Width: chartWidth, Height: chartHeight}
+	hours := getSortedKeys(perHour)
+	if len(hours) == 0 {
+		return chart
+	}
+	chart.First, chart.Last = hours[0], hours[len(hours)-1]
+	for _, hour := range hours {
+		if perHour[hour] > chart.Max {
+			chart.Max = perHour[hour]
+		}
+	}
+
+	step := float64(chartWidth) / float64(len(hours))
+	plot := float64(chartHeight - 20)
+	for i, hour := range hours {
+		h := float64(perHour[hour]) / float64(chart.Max) * plot
+		chart.Bars = append(chart.Bars, timelineBar{
+			X:     float64(i) * step,
+			Y:     plot - h,
+			W:     math.Max(step-1, 1),
+			H:     h,
+			Label: hour,
+			Value: perHour[hour],
+		})
+	}
+	return chart
+}
+
+func newBarChart(items []MapItem) barChart {
+	chart := barChart{Width: chartWidth, Height: len(items)*(barHeight+4) + 4}
+	largest := 0
+	for _, item := range items {
+		if item.Value > largest {
+			largest = item.Value
+		}
+	}
+	room := float64(chartWidth - labelWidth - 80)
+	for i, item := range items {
+		w := 0.0
+		if largest > 0 {
+			w = float64(item.Value) / float64(largest) * room
+		}
+		y := float64(i*(barHeight+4) + 2)
+		chart.Bars = append(chart.Bars, chartBar{
+			X:      labelWidth,
+			Y:      y,
+			W:      math.Max(w, 1),
+			H:      barHeight,
+			TextY:  y + barHeight*0.7,
+			ValueX: labelWidth + w + 6,
+			Label:  truncate(item.Key, 40),
+			Value:  item.Value,
+		})
+	}
+	return chart
+}
+
+// statusItems orders status codes numerically for the status chart
+func statusItems(codes map[int]int) []MapItem {
+	statuses := make([]int, 0, len(codes))
+	for status := range codes {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+	var items []MapItem
+	for _, status := range statuses {
+		items = append(items, MapItem{strconv.Itoa(status), codes[status]})
+	}
+	return items
+}
+
+func countTable(title, label string, items []MapItem, total int) htmlTable {
+	table := htmlTable{
+		Title:   title,
+		Headers: []string{label, "Requests", "Share"},
+		Numeric: []bool{false, true, true},
+	}
+	for _, item := range items {
+		share := 0.0
+		if total > 0 {
+			share = float64(item.Value) / float64(total) * 100
+		}
+		table.Rows = append(table.Rows, []htmlCell{
+			{Text: item.Key},
+			{Text: strconv.Itoa(item.Value), Sort: strconv.Itoa(item.Value)},
+			{Text: fmt.Sprintf("%.1f%%", share), Sort: strconv.FormatFloat(share, 'f', 4, 64)},
+		})
+	}
+	return table
+}
+
+func latencyTable(stats *Stats, topCount int) htmlTable {
+	table := htmlTable{
+		Title:   "Response Times by Page",
+		Headers: []string{"Page", "Count", "p50", "p90", "p95", "p99", "Max"},
+		Numeric: []bool{false, true, true, true, true, true, true},
+	}
+	cell := func(d time.Duration) htmlCell {
+		return htmlCell{Text: formatLatency(d), Sort: strconv.FormatInt(int64(d), 10)}
+	}
+	for _, item := range getSortedMapByValue(stats.TopPages, topCount) {
+		s, ok := stats.LatencyByPage[item.Key]
+		if !ok {
+			continue
+		}
+		table.Rows = append(table.Rows, []htmlCell{
+			{Text: item.Key},
+			{Text: strconv.Itoa(s.Count), Sort: strconv.Itoa(s.Count)},
+			cell(s.Quantile(0.5)), cell(s.Quantile(0.9)), cell(s.Quantile(0.95)),
+			cell(s.Quantile(0.99)), cell(s.Max),
+		})
+	}
+	return table
 }
 
+const htmlReportTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Log Analysis Report</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em auto; max-width: 960px; color: #222; }
+h1 { margin-bottom: 0; }
+.generated { color: #777; margin-top: 0.2em; }
+.summary { display: flex; flex-wrap: wrap; gap: 1em; }
+.summary div { background: #f3f5f8; border-radius: 6px; padding: 0.6em 1em; min-width: 120px; }
+.summary b { display: block; font-size: 1.4em; }
+svg { display: block; margin: 0.5em 0 1.5em; }
+svg text { font-size: 12px; fill: #333; }
+.bar { fill: #4a7bd0; }
+.bar:hover { fill: #2c5aa8; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 1.5em; }
+th, td { text-align: left; padding: 4px 8px; border-bottom: 1px solid #e3e6ea; }
+th { cursor: pointer; background: #f3f5f8; user-select: none; }
+th.num, td.num { text-align: right; }
+th.asc::after { content: " \25B2"; }
+th.desc::after { content: " \25BC"; }
+.anomaly { color: #a33; }
+</style>
+</head>
+<body>
+<h1>Log Analysis Report</h1>
+<p class="generated">Generated {{.Generated}}</p>
+
+<div class="summary">
+{{range .Summary}}<div>{{.Label}}<b>{{.Value}}</b></div>
+{{end}}</div>
+
+<h2>Requests per Hour</h2>
+{{with .Timeline}}{{if .Bars}}<svg width="{{.Width}}" height="{{.Height}}" viewBox="0 0 {{.Width}} {{.Height}}" role="img">
+{{range .Bars}}<rect class="bar" x="{{printf "%.1f" .X}}" y="{{printf "%.1f" .Y}}" width="{{printf "%.1f" .W}}" height="{{printf "%.1f" .H}}"><title>{{.Label}}: {{.Value}}</title></rect>
+{{end}}<text x="0" y="{{.Height}}">{{.First}}</text>
+<text x="{{.Width}}" y="{{.Height}}" text-anchor="end">{{.Last}}</text>
+<text x="{{.Width}}" y="12" text-anchor="end">peak {{.Max}}/hour</text>
+</svg>{{else}}<p>No requests.</p>{{end}}{{end}}
+
+<h2>Status Codes</h2>
+{{template "bars" .Status}}
+<h2>Top Pages</h2>
+{{template "bars" .Pages}}
+<h2>Top IP Addresses</h2>
+{{template "bars" .IPs}}
+
+{{if .Anomalies}}<h2>Anomalies</h2>
+<ul>
+{{range .Anomalies}}<li class="anomaly"><b>{{.Window}}</b>: {{.Description}}</li>
+{{end}}</ul>
+{{end}}
+
+{{if .Violations}}<h2>Alert Violations</h2>
+<ul>
+{{range .Violations}}<li class="anomaly"><b>{{.Window}}</b>: {{.Description}}</li>
+{{end}}</ul>
+{{end}}
+
+{{range .Tables}}<h2>{{.Title}}</h2>
+<table class="sortable">
+<thead><tr>{{$numeric := .Numeric}}{{range $i, $h := .Headers}}<th{{if index $numeric $i}} class="num"{{end}}>{{$h}}</th>{{end}}</tr></thead>
+<tbody>
+{{range .Rows}}<tr>{{range .}}<td{{if .Sort}} class="num" data-sort="{{.Sort}}"{{end}}>{{.Text}}</td>{{end}}</tr>
+{{end}}</tbody>
+</table>
+{{end}}
+
+<script>
+document.querySelectorAll("table.sortable th").forEach(function (th, _, all) {
+  th.addEventListener("click", function () {
+    var table = th.closest("table"), body = table.tBodies[0];
+    var col = Array.prototype.indexOf.call(th.parentNode.children, th);
+    var asc = !th.classList.contains("asc");
+    table.querySelectorAll("th").forEach(function (h) { h.classList.remove("asc", "desc"); });
+    th.classList.add(asc ? "asc" : "desc");
+    var rows = Array.prototype.slice.call(body.rows);
+    rows.sort(function (a, b) {
+      var x = a.cells[col], y = b.cells[col];
+      var cmp = x.dataset.sort !== undefined
+        ? parseFloat(x.dataset.sort) - parseFloat(y.dataset.sort)
+        : x.textContent.localeCompare(y.textContent);
+      return asc ? cmp : -cmp;
+    });
+    rows.forEach(function (r) { body.appendChild(r); });
+  });
+});
+</script>
+</body>
+</html>
+{{define "bars"}}{{if .Bars}}<svg width="{{.Width}}" height="{{.Height}}" viewBox="0 0 {{.Width}} {{.Height}}" role="img">
+{{range .Bars}}<text x="0" y="{{printf "%.1f" .TextY}}">{{.Label}}</text>
+<rect class="bar" x="{{.X}}" y="{{printf "%.1f" .Y}}" width="{{printf "%.1f" .W}}" height="{{.H}}"><title>{{.Label}}: {{.Value}}</title></rect>
+<text x="{{printf "%.1f" .ValueX}}" y="{{printf "%.1f" .TextY}}">{{.Value}}</text>
+{{end}}</svg>{{else}}<p>No data.</p>{{end}}{{end}}
+`
+
 func printTopMap(m map[string]int, top int, keyLabel, valueLabel string) {
 	sorted := getSortedMapByValue(m, top)
 	for _, item := range sorted {
@@ -459,7 +6000,10 @@ func printTopMapInt(m map[int]int, top int, keyLabel, valueLabel string) {
 	}
 
 	sort.Slice(items, func(i, j int) bool {
-		return items[i].Value > items[j].Value
+		if items[i].Value != items[j].Value {
+			return items[i].Value > items[j].Value
+		}
+		return items[i].Key < items[j].Key
 	})
 
 	if len(items) > top {
@@ -483,7 +6027,10 @@ func getSortedMapByValue(m map[string]int, top int) []MapItem {
 	}
 
 	sort.Slice(items, func(i, j int) bool {
-		return items[i].Value > items[j].Value
+		if items[i].Value != items[j].Value {
+			return items[i].Value > items[j].Value
+		}
+		return items[i].Key < items[j].Key
 	})
 
 	if len(items) > top {